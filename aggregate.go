@@ -0,0 +1,100 @@
+package nrinsights
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Durations kept per route per interval; beyond this, durations are reservoir sampled.
+const aggregateReservoirSize = 1024
+
+// A route's requests since the last send interval.
+type routeStats struct {
+	count     int
+	durations []float64
+	statuses  map[int]int
+}
+
+// Per-route request statistics, fed by Middleware and drained by makeBatches.
+type aggregator struct {
+	lock   sync.Mutex
+	routes map[string]*routeStats
+}
+
+func (a *aggregator) add(route string, duration float64, status int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.routes == nil {
+		a.routes = make(map[string]*routeStats)
+	}
+	rs, ok := a.routes[route]
+	if !ok {
+		rs = &routeStats{statuses: make(map[int]int)}
+		a.routes[route] = rs
+	}
+
+	rs.count++
+	rs.statuses[status]++
+	if len(rs.durations) < aggregateReservoirSize {
+		rs.durations = append(rs.durations, duration)
+	} else if i := rand.Intn(rs.count); i < aggregateReservoirSize {
+		rs.durations[i] = duration
+	}
+}
+
+// Hands back everything accumulated so far and starts a new interval.
+func (a *aggregator) take() map[string]*routeStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	routes := a.routes
+	a.routes = nil
+	return routes
+}
+
+// Queues one "AggregatedTransaction" event per aggregated route, with "route", "count",
+// "duration-p50", "duration-p95", "duration-p99", "duration-max" and a "status-<code>" count per
+// status seen.  Runs on the makeBatches goroutine.
+func (c *Connection) queueAggregates() {
+	for route, rs := range c.aggregates.take() {
+		sort.Float64s(rs.durations)
+
+		e := c.NewEvent()
+		e.SetSource("nrinsights")
+		e.Set("eventType", "AggregatedTransaction")
+		e.SetTimestamp(time.Now())
+		e.Set("route", route)
+		e.Set("count", rs.count)
+		e.Set("duration-p50", percentile(rs.durations, 0.50))
+		e.Set("duration-p95", percentile(rs.durations, 0.95))
+		e.Set("duration-p99", percentile(rs.durations, 0.99))
+		e.Set("duration-max", rs.durations[len(rs.durations)-1])
+		for status, n := range rs.statuses {
+			e.Set("status-"+strconv.Itoa(status), n)
+		}
+
+		qe, err := c.prepareEvent(e)
+		if err != nil {
+			c.log().Printf("insights queueAggregates: dropping aggregate for route %q: %v", route, err)
+			continue
+		}
+		c.queueEvent(qe)
+		c.publish(qe.json)
+	}
+}
+
+// Nearest-rank percentile of sorted, which must not be empty.
+func percentile(sorted []float64, p float64) float64 {
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
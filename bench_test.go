@@ -0,0 +1,67 @@
+package nrinsights
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// A Sender discarding every batch.
+type nopSender struct{}
+
+func (nopSender) Send(ctx context.Context, batch []byte, dest Destination) error {
+	return nil
+}
+
+type benchTransaction struct {
+	EventType string  `json:"eventType"`
+	Timestamp int64   `json:"timestamp"`
+	URL       string  `json:"url"`
+	Method    string  `json:"method"`
+	Status    int     `json:"status-code"`
+	Duration  float64 `json:"duration"`
+	Host      string  `json:"host"`
+}
+
+func startBench(b *testing.B, c *Connection) *Connection {
+	c.Sender = nopSender{}
+	if err := c.Start(); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(c.StopAndFlush)
+	b.ReportAllocs()
+	b.ResetTimer()
+	return c
+}
+
+func BenchmarkRegisterEvent(b *testing.B) {
+	c := startBench(b, &Connection{})
+	for i := 0; i < b.N; i++ {
+		e := c.NewEvent()
+		e.Set("url", "/api/things")
+		e.Set("method", "GET")
+		e.Set("status-code", 200)
+		e.Set("duration", 0.012)
+		if err := c.RegisterEvent(e); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRegisterTyped(b *testing.B) {
+	c := startBench(b, &Connection{})
+	for i := 0; i < b.N; i++ {
+		err := c.RegisterTyped(benchTransaction{
+			EventType: "Transaction",
+			Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+			URL:       "/api/things",
+			Method:    "GET",
+			Status:    200,
+			Duration:  0.012,
+			Host:      "bench",
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+//go:build darwin || freebsd || linux || netbsd || openbsd
+// +build darwin freebsd linux netbsd openbsd
+
+package nrinsights
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The process's CPU time so far, user and system.
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// Queues events at about 50k a second, in a burst each millisecond, reporting the CPU spent per
+// event with and without coalescing the batching goroutine's reads.  Events are marshaled once up
+// front, so what's measured is handing them over and batching them, which coalescing affects,
+// rather than RegisterEvent's marshaling, which it doesn't.
+func BenchmarkCoalesceEvents(b *testing.B) {
+	const perMillisecond = 50
+	const event = `{"eventType":"Transaction","url":"/api/things"}`
+	for _, n := range []int{1, defaultCoalesceEvents} {
+		b.Run(fmt.Sprintf("CoalesceEvents=%d", n), func(b *testing.B) {
+			c := startBench(b, &Connection{CoalesceEvents: n})
+			pace := time.NewTicker(time.Millisecond)
+			defer pace.Stop()
+
+			before := cpuTime(b)
+			for i := 0; i < b.N; i++ {
+				if i%perMillisecond == 0 {
+					<-pace.C
+				}
+				c.reserveMemory(len(event))
+				if err := c.enqueue(queuedEvent{json: event}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(cpuTime(b)-before)/float64(b.N), "cpu-ns/event")
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package nrinsights
+
+import "time"
+
+// The batching and sending timers' source of time, replaceable in tests with one that steps on
+// demand.
+type clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+type ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// The time package's clock, the default.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) Chan() <-chan time.Time {
+	return t.C
+}
+
+// The current time per c.clock, which is set at Start.
+func (c *Connection) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
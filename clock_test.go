@@ -0,0 +1,236 @@
+package nrinsights
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock standing still until Advance.  Each NewTicker and After reports its duration on
+// tickers or afters, so a test can wait until a goroutine is blocked on one before stepping.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	pending []*fakeTicker // tickers, and After's one-shot timers (period 0)
+
+	tickers chan time.Duration
+	afters  chan time.Duration
+}
+
+type fakeTicker struct {
+	clock   *fakeClock
+	c       chan time.Time
+	next    time.Time
+	period  time.Duration
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		tickers: make(chan time.Duration, 100),
+		afters:  make(chan time.Duration, 1000),
+	}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) start(d, period time.Duration) *fakeTicker {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	t := &fakeTicker{clock: fc, c: make(chan time.Time, 1), next: fc.now.Add(d), period: period}
+	if d <= 0 && period == 0 {
+		t.c <- fc.now
+		return t
+	}
+	fc.pending = append(fc.pending, t)
+	return t
+}
+
+func (fc *fakeClock) NewTicker(d time.Duration) ticker {
+	t := fc.start(d, d)
+	report(fc.tickers, d)
+	return t
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	t := fc.start(d, 0)
+	report(fc.afters, d)
+	return t.c
+}
+
+func report(ch chan time.Duration, d time.Duration) {
+	select {
+	case ch <- d:
+	default:
+	}
+}
+
+// Steps the clock by d, firing whatever comes due; like time's, a ticker that's not been read
+// drops ticks.
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.now = fc.now.Add(d)
+	kept := fc.pending[:0]
+	for _, t := range fc.pending {
+		if t.stopped {
+			continue
+		}
+		for !t.next.After(fc.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			if t.period == 0 {
+				t.stopped = true
+				break
+			}
+			t.next = t.next.Add(t.period)
+		}
+		if !t.stopped {
+			kept = append(kept, t)
+		}
+	}
+	fc.pending = kept
+}
+
+func (t *fakeTicker) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
+
+// Waits until something calls ch's method (NewTicker or After) with d.
+func awaitTimer(t *testing.T, ch chan time.Duration, d time.Duration) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case got := <-ch:
+			if got == d {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("nothing waiting on a %v timer", d)
+		}
+	}
+}
+
+// Waits up to 2s for sender to have n batches.
+func awaitBatches(t *testing.T, sender *recordingSender, n int) []string {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if sent := sender.sent(); len(sent) >= n {
+			return sent
+		}
+	}
+	t.Fatalf("%d batches sent, want %d", len(sender.sent()), n)
+	return nil
+}
+
+// Fails if sender gets a batch past its first n in the next little while.
+func expectNoBatch(t *testing.T, sender *recordingSender, n int) {
+	t.Helper()
+	time.Sleep(20 * time.Millisecond)
+	if sent := sender.sent(); len(sent) > n {
+		t.Fatalf("%d batches sent, want %d", len(sent), n)
+	}
+}
+
+func TestBatchOnTick(t *testing.T) {
+	fc := newFakeClock()
+	sender := &recordingSender{}
+	c := startTest(t, &Connection{Sender: sender, SendInterval: time.Minute, clock: fc})
+	awaitTimer(t, fc.tickers, time.Minute)
+
+	c.RegisterEvent(c.NewEvent())
+	fc.Advance(time.Minute - time.Second)
+	expectNoBatch(t, sender, 0)
+
+	fc.Advance(time.Second)
+	awaitBatches(t, sender, 1)
+}
+
+func TestInitialFlushDelay(t *testing.T) {
+	fc := newFakeClock()
+	sender := &recordingSender{}
+	c := startTest(t, &Connection{Sender: sender, InitialFlushDelay: 5 * time.Second, clock: fc})
+	awaitTimer(t, fc.afters, 5*time.Second)
+
+	c.RegisterEvent(c.NewEvent())
+	fc.Advance(5 * time.Second)
+	awaitBatches(t, sender, 1)
+}
+
+func TestEarlyBatch(t *testing.T) {
+	fc := newFakeClock()
+	sender := &recordingSender{}
+	c := startTest(t, &Connection{Sender: sender, EarlyBatchFraction: 0.1, clock: fc})
+
+	limit := int(maxEventsPerCall * 0.1)
+	for i := 0; i < limit; i++ {
+		c.RegisterEvent(c.NewEvent())
+	}
+	expectNoBatch(t, sender, 0)
+
+	c.RegisterEvent(c.NewEvent())
+	if sent := awaitBatches(t, sender, 1); strings.Count(sent[0], `"eventType"`) != limit+1 {
+		t.Errorf("early batch of %d events, want %d", strings.Count(sent[0], `"eventType"`), limit+1)
+	}
+}
+
+func TestRetryAfterBackoff(t *testing.T) {
+	fc := newFakeClock()
+	sender := &recordingSender{err: errors.New("unavailable")}
+	c := startTest(t, &Connection{Sender: sender, RetryBackoff: 10 * time.Second, clock: fc})
+	c.RegisterEvent(c.NewEvent())
+	c.FlushType("Transaction") // batched at once, sent soon after
+	awaitBatches(t, sender, 1)
+
+	awaitTimer(t, fc.afters, 10*time.Second)
+	fc.Advance(10*time.Second - time.Millisecond)
+	expectNoBatch(t, sender, 1)
+
+	fc.Advance(time.Millisecond)
+	awaitBatches(t, sender, 2)
+}
+
+func TestShutdownRetries(t *testing.T) {
+	fc := newFakeClock()
+	sender := &recordingSender{err: errors.New("unavailable")}
+	c := startTest(t, &Connection{Sender: sender, RetryBackoff: time.Hour, ShutdownRetries: 2, clock: fc})
+	c.RegisterEvent(c.NewEvent())
+	c.FlushType("Transaction")
+	awaitBatches(t, sender, 1) // failed, and not due again for an hour
+
+	stopped := make(chan bool)
+	go func() {
+		c.StopAndFlush()
+		close(stopped)
+	}()
+	for sends := 2; sends <= 3; sends++ {
+		awaitTimer(t, fc.afters, shutdownRetryDelay)
+		awaitBatches(t, sender, sends)
+		fc.Advance(shutdownRetryDelay)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("StopAndFlush still running after its retries")
+	}
+	if n := len(sender.sent()); n != 4 {
+		t.Errorf("%d sends, want 4: one before StopAndFlush, then one and ShutdownRetries more", n)
+	}
+}
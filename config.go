@@ -0,0 +1,97 @@
+package nrinsights
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The settings UpdateConfig can change on a running Connection; each is as the Connection field
+// of the same name.  The rest (queue and channel sizes, lanes, hooks, credentials other than
+// SetInsertKey's) are fixed at Start, and changing them takes a restart.
+type Config struct {
+	SendInterval         time.Duration
+	HighPriorityInterval time.Duration
+	MaxQueryParams       int
+	QueryParamsToSkip    []string
+	QueryParamsToRedact  []string
+	FlattenPosts         bool
+	FlattenStyle         SeparatorStyle
+	FlattenSampleRate    float64
+	MaxBodyBytes         int64
+}
+
+// A Config in effect, with what's derived from it.
+type liveConfig struct {
+	Config
+	skipParams   map[string]bool // QueryParamsToSkip, lowercased
+	redactParams map[string]bool // QueryParamsToRedact, lowercased
+}
+
+func newLiveConfig(cfg Config) *liveConfig {
+	if cfg.FlattenStyle == 0 {
+		cfg.FlattenStyle = DotStyle
+	}
+
+	live := &liveConfig{Config: cfg, skipParams: make(map[string]bool), redactParams: make(map[string]bool)}
+	for _, p := range cfg.QueryParamsToSkip {
+		live.skipParams[strings.ToLower(p)] = true
+	}
+	for _, p := range cfg.QueryParamsToRedact {
+		live.redactParams[strings.ToLower(p)] = true
+	}
+	return live
+}
+
+// The Config of c's fields, as Start takes them up.
+func (c *Connection) fieldConfig() Config {
+	return Config{
+		SendInterval:         c.SendInterval,
+		HighPriorityInterval: c.HighPriorityInterval,
+		MaxQueryParams:       c.MaxQueryParams,
+		QueryParamsToSkip:    c.QueryParamsToSkip,
+		QueryParamsToRedact:  c.QueryParamsToRedact,
+		FlattenPosts:         c.FlattenPosts,
+		FlattenStyle:         c.FlattenStyle,
+		FlattenSampleRate:    c.FlattenSampleRate,
+		MaxBodyBytes:         c.MaxBodyBytes,
+	}
+}
+
+// The Config in effect: that of the last UpdateConfig, else of c's fields.
+func (c *Connection) config() *liveConfig {
+	if live, ok := c.live.Load().(*liveConfig); ok {
+		return live
+	}
+	return newLiveConfig(c.fieldConfig()) // not started
+}
+
+// Applies cfg to the running Connection in place of its current settings, all at once: requests
+// and batches from then on see all of it, and queued events and unsent batches are kept.  The send
+// intervals restart from the call, MaxBatchesPerTick's pacing with them.  Returns an error,
+// changing nothing, for an invalid cfg, or ErrNotStarted before Start (which would replace cfg
+// with c's fields).  c's fields are left as they were given to Start.
+func (c *Connection) UpdateConfig(cfg Config) error {
+	if c.reconfig == nil {
+		return ErrNotStarted
+	}
+	if cfg.SendInterval < 0 || cfg.HighPriorityInterval < 0 {
+		return fmt.Errorf("insights: send intervals can't be negative")
+	}
+	if cfg.FlattenSampleRate < 0 || cfg.FlattenSampleRate > 1 {
+		return fmt.Errorf("insights: FlattenSampleRate must be between 0 and 1, not %v", cfg.FlattenSampleRate)
+	}
+	if cfg.FlattenStyle != 0 && cfg.FlattenStyle != DotStyle && cfg.FlattenStyle != RailsStyle {
+		return fmt.Errorf("insights: unknown FlattenStyle %d", cfg.FlattenStyle)
+	}
+
+	c.live.Store(newLiveConfig(cfg))
+
+	for _, ch := range []chan bool{c.reconfig, c.repace} {
+		select {
+		case ch <- true:
+		default: // the tickers are already due a reset
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package nrinsights
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateConfigBeforeStart(t *testing.T) {
+	c := &Connection{MaxQueryParams: 5}
+	if err := c.UpdateConfig(Config{MaxQueryParams: 1}); err != ErrNotStarted {
+		t.Fatalf("UpdateConfig before Start = %v, want ErrNotStarted", err)
+	}
+	startTest(t, c)
+	if n := c.config().MaxQueryParams; n != 5 {
+		t.Errorf("MaxQueryParams %d after Start, want the field's 5", n)
+	}
+	if err := c.UpdateConfig(Config{MaxQueryParams: 1}); err != nil || c.config().MaxQueryParams != 1 {
+		t.Errorf("UpdateConfig = %v with MaxQueryParams %d, want nil, 1", err, c.config().MaxQueryParams)
+	}
+}
+
+func TestUpdateConfigRepaces(t *testing.T) {
+	fc := newFakeClock()
+	sender := &recordingSender{}
+	c := startTest(t, &Connection{Sender: sender, SendInterval: time.Minute, MaxBatchesPerTick: 1, clock: fc})
+	for i := 0; i < 2; i++ { // makeBatches' and sendBatches' pace
+		awaitTimer(t, fc.tickers, time.Minute)
+	}
+
+	if err := c.UpdateConfig(Config{SendInterval: 10 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		awaitTimer(t, fc.tickers, 10*time.Second)
+	}
+
+	for i := 0; i < 2; i++ {
+		c.RegisterEvent(c.NewEvent())
+		c.FlushType("Transaction")
+	}
+	awaitBatches(t, sender, 1)
+	expectNoBatch(t, sender, 1) // the second waits for the next interval
+
+	fc.Advance(10 * time.Second)
+	awaitBatches(t, sender, 2)
+}
@@ -0,0 +1,80 @@
+package nrinsights
+
+import (
+	"sync"
+	"time"
+)
+
+// When each event type last had a limit warning.
+type limitWarnings struct {
+	lock sync.Mutex
+	last map[string]time.Time
+}
+
+// Whether eventType is due for another warning, noting that it's had one if so.
+func (lw *limitWarnings) due(eventType string, now time.Time) bool {
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
+
+	if lw.last == nil {
+		lw.last = make(map[string]time.Time)
+	}
+	if last, ok := lw.last[eventType]; ok && now.Sub(last) < limitWarningInterval {
+		return false
+	}
+	lw.last[eventType] = now
+	return true
+}
+
+// Warns, per c.LimitWarningFraction, when e nears the attribute or value size limits in effect
+// (MaxAttributes and MaxValueBytes, New Relic's by default).
+func (c *Connection) checkLimits(e *Event) {
+	largest := 0
+	for _, v := range e.values {
+		if str, ok := v.(string); ok && len(str) > largest {
+			largest = len(str)
+		}
+	}
+
+	attributes := len(e.values)
+	attributeLimit, valueLimit := c.maxAttributes(), c.maxValueBytes()
+	nearValueLimit := valueLimit > 0 && float64(largest) >= c.LimitWarningFraction*float64(valueLimit)
+	if float64(attributes) < c.LimitWarningFraction*float64(attributeLimit) && !nearValueLimit {
+		return
+	}
+
+	eventType, _ := e.values["eventType"].(string)
+	if eventType == "InsightsLimitWarning" || !c.warnings.due(eventType, c.now()) {
+		return
+	}
+
+	if c.OnLimitWarning != nil {
+		c.OnLimitWarning(eventType, attributes, largest)
+		return
+	}
+
+	warning := c.NewEvent()
+	warning.SetSource("nrinsights")
+	warning.Set("eventType", "InsightsLimitWarning")
+	warning.Set("warnedEventType", eventType)
+	warning.Set("attributes", attributes)
+	warning.Set("attributeLimit", attributeLimit)
+	warning.Set("largestValueBytes", largest)
+	if valueLimit > 0 {
+		warning.Set("valueBytesLimit", valueLimit)
+	}
+
+	qe, err := c.prepareEvent(warning)
+	if err != nil {
+		return
+	}
+
+	// Possibly on the batching goroutine (e.g. for aggregates), so never block, and use a channel
+	// of its own that StopAndFlush leaves open.
+	select {
+	case c.warnEvents <- qe:
+		c.publish(qe.json)
+	default:
+		c.releaseMemory(len(qe.json))
+	}
+}
@@ -0,0 +1,63 @@
+package nrinsights
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLimitWarningsUseConfiguredLimits(t *testing.T) {
+	type warning struct{ attributes, largest int }
+	tests := []struct {
+		name      string
+		c         *Connection
+		attrs     int
+		valueSize int
+		warned    bool
+	}{
+		{"under MaxAttributes", &Connection{MaxAttributes: 50}, 40, 0, false},
+		{"near MaxAttributes", &Connection{MaxAttributes: 50}, 46, 0, true},
+		{"near MaxValueBytes", &Connection{MaxValueBytes: 100}, 0, 95, true},
+		{"MaxValueBytes disabled", &Connection{MaxValueBytes: -1}, 0, 2 * maxValueBytes, false},
+	}
+	for _, test := range tests {
+		var got []warning
+		test.c.LimitWarningFraction = 0.9
+		test.c.OnLimitWarning = func(eventType string, attributes, largest int) {
+			got = append(got, warning{attributes, largest})
+		}
+		e := test.c.NewEvent()
+		for i := len(e.values); i < test.attrs; i++ {
+			e.Set(fmt.Sprintf("attr%02d", i), i)
+		}
+		if test.valueSize > 0 {
+			e.Set("body", string(make([]byte, test.valueSize)))
+		}
+
+		test.c.checkLimits(e)
+		if warned := len(got) > 0; warned != test.warned {
+			t.Errorf("%s: warned %v, want %v", test.name, warned, test.warned)
+		}
+	}
+}
+
+func TestLimitWarningEventReportsConfiguredLimit(t *testing.T) {
+	c := startTest(t, &Connection{MaxAttributes: 20, LimitWarningFraction: 0.5})
+	ch := c.Subscribe()
+	e := c.NewEvent()
+	for i := len(e.values); i < 15; i++ {
+		e.Set(fmt.Sprintf("attr%02d", i), i)
+	}
+	if err := c.RegisterEvent(e); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if event := nextEvent(t, ch); event["eventType"] == "InsightsLimitWarning" {
+			if event["attributeLimit"] != float64(20) {
+				t.Errorf("attributeLimit = %v, want MaxAttributes' 20", event["attributeLimit"])
+			}
+			return
+		}
+	}
+	t.Error("no InsightsLimitWarning")
+}
@@ -0,0 +1,61 @@
+// Package nrgrpc records gRPC server calls as nrinsights events, the counterpart of
+// Connection.Middleware for HTTP.
+//
+//	server := grpc.NewServer(
+//	    grpc.UnaryInterceptor(nrgrpc.UnaryServerInterceptor(insights)),
+//	    grpc.StreamInterceptor(nrgrpc.StreamServerInterceptor(insights)),
+//	)
+package nrgrpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/mandagill/nrinsights"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Registers an event per unary call with "grpc-method", "duration" in floating point seconds,
+// "grpc-code", and the connection's GRPCMetadataToCapture.
+func UnaryServerInterceptor(c *nrinsights.Connection) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		e := newEvent(ctx, c, info.FullMethod)
+
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		finish(c, e, start, err)
+
+		return resp, err
+	}
+}
+
+// Registers an event per streaming call, as UnaryServerInterceptor does, once the stream ends.
+func StreamServerInterceptor(c *nrinsights.Connection) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		e := newEvent(ss.Context(), c, info.FullMethod)
+
+		start := time.Now()
+		err := handler(srv, ss)
+		finish(c, e, start, err)
+
+		return err
+	}
+}
+
+func newEvent(ctx context.Context, c *nrinsights.Connection, method string) *nrinsights.Event {
+	e := c.NewEvent()
+	e.SetSource("grpc")
+	e.Set("grpc-method", method)
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		c.SetMetadata(e, md)
+	}
+	return e
+}
+
+func finish(c *nrinsights.Connection, e *nrinsights.Event, start time.Time, err error) {
+	e.Set("duration", time.Since(start).Seconds())
+	e.Set("grpc-code", status.Code(err).String())
+	c.RegisterEvent(e)
+}
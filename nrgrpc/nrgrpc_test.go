@@ -0,0 +1,134 @@
+package nrgrpc
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mandagill/nrinsights"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type nopSender struct{}
+
+func (nopSender) Send(ctx context.Context, batch []byte, dest nrinsights.Destination) error {
+	return nil
+}
+
+// A started Connection capturing and redacting metadata, and a subscription to its events.
+func start(t *testing.T) (*nrinsights.Connection, <-chan []byte) {
+	c := &nrinsights.Connection{
+		Sender:                nopSender{},
+		GRPCMetadataToCapture: []string{"User-Agent", "x-tenant", "authorization", "x-absent"},
+		GRPCMetadataToRedact:  []string{"Authorization"},
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.StopAndFlush)
+	return c, c.Subscribe()
+}
+
+func nextEvent(t *testing.T, ch <-chan []byte) map[string]interface{} {
+	t.Helper()
+	select {
+	case event := <-ch:
+		var values map[string]interface{}
+		if err := json.Unmarshal(event, &values); err != nil {
+			t.Fatal(err)
+		}
+		return values
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event registered")
+		return nil
+	}
+}
+
+func incoming() context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.MD{
+		"user-agent":    {"grpc-go/1.60"},
+		"x-tenant":      {"acme", "globex"},
+		"authorization": {"Bearer secret"},
+		"x-unlisted":    {"ignored"},
+	})
+}
+
+func checkMetadata(t *testing.T, event map[string]interface{}) {
+	t.Helper()
+	want := map[string]interface{}{
+		"md:user-agent":    "grpc-go/1.60",
+		"md:x-tenant":      "acme,globex",
+		"md:authorization": "[redacted]",
+	}
+	for k, v := range want {
+		if event[k] != v {
+			t.Errorf("%s = %v, want %v", k, event[k], v)
+		}
+	}
+	for _, k := range []string{"md:x-absent", "md:x-unlisted"} {
+		if v, ok := event[k]; ok {
+			t.Errorf("%s = %v, want none", k, v)
+		}
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	c, ch := start(t)
+	intercept := UnaryServerInterceptor(c)
+	info := &grpc.UnaryServerInfo{FullMethod: "/shop.Cart/Get"}
+
+	resp, err := intercept(incoming(), "req", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "resp", nil
+	})
+	if resp != "resp" || err != nil {
+		t.Errorf("interceptor returned %v, %v; want the handler's", resp, err)
+	}
+	event := nextEvent(t, ch)
+	if event["grpc-method"] != "/shop.Cart/Get" || event["grpc-code"] != "OK" {
+		t.Errorf("grpc-method %v, grpc-code %v", event["grpc-method"], event["grpc-code"])
+	}
+	if _, ok := event["duration"].(float64); !ok {
+		t.Errorf("duration = %v, want seconds", event["duration"])
+	}
+	checkMetadata(t, event)
+
+	_, err = intercept(context.Background(), "req", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "no cart")
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("interceptor returned %v, want the handler's NotFound", err)
+	}
+	if event := nextEvent(t, ch); event["grpc-code"] != "NotFound" {
+		t.Errorf("grpc-code = %v, want NotFound", event["grpc-code"])
+	}
+}
+
+// A ServerStream carrying just a context.
+type stream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s stream) Context() context.Context { return s.ctx }
+
+func TestStreamServerInterceptor(t *testing.T) {
+	c, ch := start(t)
+	intercept := StreamServerInterceptor(c)
+	info := &grpc.StreamServerInfo{FullMethod: "/shop.Cart/Watch", IsServerStream: true}
+
+	err := intercept(nil, stream{ctx: incoming()}, info, func(srv interface{}, ss grpc.ServerStream) error {
+		return status.Error(codes.Unavailable, "draining")
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("interceptor returned %v, want the handler's Unavailable", err)
+	}
+	event := nextEvent(t, ch)
+	if event["grpc-method"] != "/shop.Cart/Watch" || event["grpc-code"] != "Unavailable" {
+		t.Errorf("grpc-method %v, grpc-code %v", event["grpc-method"], event["grpc-code"])
+	}
+	checkMetadata(t, event)
+}
@@ -1,32 +1,68 @@
 // TODO: docs
-// TODO: tests
-// TODO: pluggable logger
 
 package nrinsights
 
 import (
 	"bytes"
+	"compress/gzip"
 	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"log"
+	mathrand "math/rand"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/jeremywohl/flatten"
 )
 
+// Returned by RegisterEvent once StopAndFlush has begun.
+var ErrConnectionClosed = errors.New("insights: connection closed")
+
+// Returned by calls needing the batching goroutines before Start has run.
+var ErrNotStarted = errors.New("insights: connection not started")
+
+// Library version, reported in the default User-Agent.
+const Version = "0.1.0"
+
 const (
-	// How often event batches are sent.
+	// How often event batches are sent, without SendInterval.
 	sendInterval = 60 * time.Second
 
 	// We queue batches when New Relic is unresponsive.
 	// sendInterval * sendQueueSize == <number of seconds before we start dropping event batches>
 	sendQueueSize = 20
 
+	// Fraction of New Relic's per-call limits at which a queue is batched early, without
+	// EarlyBatchFraction.
+	earlyBatchFraction = 0.90
+
 	// Maximum events per call, defined by New Relic.
 	maxEventsPerCall = 1000
 
@@ -38,6 +74,52 @@ const (
 
 	// Fast HTTP timeout, for exit cleanup.
 	fastHttpTimeout = 2 * time.Second
+
+	// Pause between the final flush's retries.
+	shutdownRetryDelay = 500 * time.Millisecond
+
+	// Pause between Flush's checks on sends still due.
+	flushPollDelay = 50 * time.Millisecond
+
+	// Fill fractions of the batch queue at which OnBackpressure reports overload, then recovery.
+	backpressureHigh = 0.80
+	backpressureLow  = 0.50
+
+	// Default cap on query params captured per request.
+	defaultMaxQueryParams = 64
+
+	// How often HighPriority events are batched, by default.
+	highPriorityInterval = 5 * time.Second
+
+	// Default cap on distinct BatchKey queues held at once.
+	defaultMaxBatchQueues = 64
+
+	// Default cap on events queued per wake-up of the batching goroutine.
+	defaultCoalesceEvents = 128
+
+	// Most bytes of a body decompressed, without MaxBodyBytes.
+	defaultMaxBodyBytes = 1 << 20
+
+	// Maximum bytes per string attribute value, defined by New Relic.
+	maxValueBytes = 4096
+
+	// Maximum eventType length, defined by New Relic.
+	maxEventTypeLen = 255
+
+	// Maximum attributes per event, defined by New Relic.
+	maxAttributes = 254
+
+	// The "url" of requests c.UnmatchedRoute reports matched no route.
+	unmatchedURL = "<unmatched>"
+
+	// The first resend delay, without RetryBackoff.
+	defaultRetryBackoff = time.Second
+
+	// Marshaled events buffered per Subscribe channel before further ones are dropped.
+	subscriberBuffer = 256
+
+	// Least time between limit warnings for any one event type.
+	limitWarningInterval = time.Minute
 )
 
 type SeparatorStyle int
@@ -52,293 +134,3000 @@ const (
 	RailsStyle = SeparatorStyle(flatten.RailsStyle)
 )
 
+type TimestampStrategy int
+
+const (
+	// Middleware events are stamped when the request arrives (default).
+	ArrivalTimestamp TimestampStrategy = iota
+
+	// Middleware events are stamped when the response has finished.
+	CompletionTimestamp
+)
+
+// Converts a value of a registered type into one encoding/json marshals as wanted.
+type Encoder func(v interface{}) interface{}
+
+// What RegisterEvent does with an event over MaxAttributes.
+type AttributePolicy int
+
+const (
+	// The event is rejected with an error (default).
+	RejectExtraAttributes AttributePolicy = iota
+
+	// Attributes past the limit are dropped, by sorted name ("eventType" and "timestamp" are
+	// always kept), and logged.
+	DropExtraAttributes
+)
+
+// How RegisterEvent handles attribute values New Relic doesn't accept: anything but strings,
+// numbers and booleans (after RegisterEncoder's encoders), such as a slice, map or struct set by
+// a Mutator.
+type ValuePolicy int
+
+const (
+	// The value is replaced by its JSON text, e.g. "[1,2]" (default).
+	StringifyUnsupported ValuePolicy = iota
+
+	// The attribute is dropped, and logged.
+	DropUnsupported
+)
+
+// What RegisterEvent does with an event too large, marshaled, for any batch.
+type OversizePolicy int
+
+const (
+	// The event is rejected with an error (default).
+	RejectOversized OversizePolicy = iota
+
+	// The event's largest string values are cut short (ending "…[truncated]") until it fits.
+	TruncateOversized
+)
+
+type SanitizeMode int
+
+const (
+	// String values are sent as set (default).
+	LeaveControlChars SanitizeMode = iota
+
+	// Control characters (other than tab, newline, and carriage return) and invalid UTF-8 are removed.
+	StripControlChars
+
+	// Control characters (other than tab, newline, and carriage return) and invalid UTF-8 are each
+	// replaced with U+FFFD.
+	ReplaceControlChars
+)
+
+// The New Relic datacenter an account's data lives in.
+type Region int
+
+const (
+	// insights-collector.newrelic.com (default).
+	RegionUS Region = iota
+
+	// insights-collector.eu01.nr-data.net.
+	RegionEU
+
+	// gov-insights-collector.newrelic.com, for FedRAMP-authorized accounts.
+	RegionFedRAMP
+)
+
+var collectorHosts = map[Region]string{
+	RegionUS:      "insights-collector.newrelic.com",
+	RegionEU:      "insights-collector.eu01.nr-data.net",
+	RegionFedRAMP: "gov-insights-collector.newrelic.com",
+}
+
+type Priority int
+
+const (
+	// Batched every send interval (default).
+	NormalPriority Priority = iota
+
+	// Batched in a lane of its own every HighPriorityInterval, with its own batch queue, and sent
+	// ahead of NormalPriority batches.
+	HighPriority
+)
+
 type Connection struct {
 	NewRelicAccountId int
 	NewRelicAppId     int
-	InsightsAPIKey    string
+	InsightsAPIKey    string // read at Start; use SetInsertKey to change it afterwards
+
+	// Human-readable application name, sent on every event as "appName" when set
+	AppName string
+
+	// Where this server runs, e.g. from AWS_REGION or the Kubernetes zone label; when set, every
+	// event carries them as "region" and "zone" alongside "host"
+	ServerRegion string
+	ServerZone   string
+
+	// Which datacenter's collector events are sent to, RegionUS by default
+	Region Region
+
+	// Collector base URL (scheme and host, e.g. "https://insights.example.com") in place of
+	// Region's, e.g. for a proxy
+	Endpoint string
+
+	// "eventType" of NewEvent's events, defaults to "Transaction"
+	EventType string
+
+	// Whether NewEvent's "timestamp" is in milliseconds rather than seconds
+	MillisecondTimestamps bool
+
+	// Per eventType, whether timestamps of events typed by NewEvent or SetEventType are in
+	// milliseconds, in place of MillisecondTimestamps.  New Relic tells the unit from the magnitude
+	// alone, so a value set directly in the other unit is misread as far off in time.
+	TimestampMilliseconds map[string]bool
+
+	// Where the Connection logs failures, defaults to the standard log package
+	Logger Logger
+
+	// Delivers batches somewhere other than New Relic Insights (see the otlp subpackage), defaults
+	// to Insights itself
+	Sender Sender
+
+	// Client for requests to New Relic, in place of one built per the pooling and pinning fields
+	// below; each request is still limited to the Connection's HTTP timeout
+	HTTPClient *http.Client
+
+	// Connection pooling for requests to New Relic; zero values keep http.DefaultTransport's
+	// (100, 2, and 90s).  Every send goes to the same collector host, so MaxIdleConnsPerHost is the
+	// one that matters -- raise it to the number of sends you expect in flight at once.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	// SHA-256 fingerprints (hex, colons optional) of certificates to pin; when set, the collector's
+	// TLS connection must present a certificate matching one of them, anywhere in its chain.  To
+	// rotate, add the new fingerprint alongside the old before the collector's certificate
+	// changes, and drop the old one after -- or pin an intermediate, which changes less often.
+	PinnedCertFingerprints []string
+
+	// Whether every event carries the binary's VCS revision as "commit", and "commit-dirty" for
+	// uncommitted changes, as embedded by go build; omitted when absent (e.g. with go run)
+	RecordCommit bool
+
+	// Whether every event carries "uptime-seconds", the time since Start
+	RecordUptime bool
+
+	// Whether Start registers an "InsightsConfig" event recording the effective settings (never
+	// credentials), e.g. to find misconfigured instances across a fleet
+	EmitStartupConfig bool
+
+	// Called after every attempt to send a batch, on the sending goroutine
+	OnSend func(SendResult)
+
+	// Whether sends to Insights are traced with net/http/httptrace, giving each SendResult a Trace
+	TraceSends bool
+
+	// Dot-separated path (e.g. "partialSuccess.rejected") to the count of rejected events in a
+	// collector's 2xx response body, for gateways reporting partial success; Stats counts them
+	RejectedEventsPath string
+
+	// Called with a batch the collector partly rejected per RejectedEventsPath, e.g. to dead-letter
+	// it, on the sending goroutine
+	OnRejected func(batch []byte, rejected int)
+
+	// Whether batches are gzipped for sending to Insights, compressed once and kept for resends
+	Compress bool
+
+	// User-Agent for requests to New Relic, defaults to "nrinsights-go/<Version>"
+	UserAgent string
+
+	// Whether events carry the request's media types as "content-type" and "accept", without
+	// parameters such as charset or q (e.g. "application/json" and "text/html,*/*")
+	CaptureContentTypes bool
+
+	// Whether captured media types are also kept as sent, in "content-type-raw" and "accept-raw"
+	RawContentTypes bool
+
+	// Whether events of TLS requests carry the SNI server name the client asked for, as "tls-sni"
+	CaptureTLS bool
+
+	// Request headers (matched case-insensitively) captured as "h:<header>", as listed here,
+	// multiple values joined with ","
+	HeadersToCapture []string
+
+	// Whether "clientIp" is taken from X-Forwarded-For (its first hop) or X-Real-IP when present,
+	// rather than the connection's address, e.g. behind a proxy that sets them
+	TrustProxyHeaders bool
 
 	// HTTP request params to be ignored
 	QueryParamsToSkip []string
 
-	// Whether to flatten POST bodies and assign separate keys to each -- these must uniformly be JSON bodies
+	// HTTP request params (matched case-insensitively) kept with their values replaced by
+	// "[redacted]", e.g. to count them without recording them; also applies to flattened POST
+	// body keys, as flattened without ParamPrefix (e.g. "user.email")
+	QueryParamsToRedact []string
+
+	// Whether QueryParamsToRedact values are replaced by their SHA-256 hex instead, so equal
+	// values can still be told apart
+	HashRedactedParams bool
+
+	// Most query params captured per request, defaults to 64 (negative for no limit).  Past it, the
+	// remaining params (by sorted key) are left off and "query-params-truncated" is set.
+	MaxQueryParams int
+
+	// Whether a query param given more than once keeps all its values, comma-joined in order, rather
+	// than just the first
+	MultiValueParams bool
+
+	// Prefix of query param and flattened POST body attribute names, defaults to "p:"
+	ParamPrefix string
+
+	// Whether events carry numeric "request-bytes" (body length) and, from Middleware, "response-bytes"
+	// (body bytes the handler wrote, headers aside, whether or not it called WriteHeader).  Middleware
+	// events carry that count as "responseBytes" regardless.
+	CaptureSizes bool
+
+	// Decides per request whether a POST body is captured at all; when false it isn't even read.
+	// Nil captures every POST body.
+	ShouldCaptureBody func(r *http.Request) bool
+
+	// Whether to flatten POST bodies and assign separate keys to each -- only those with a JSON
+	// Content-Type ("application/json" or a "+json" suffix) or a form one (URL-encoded or
+	// multipart, whose fields are set as query params are), others being stored whole
 	FlattenPosts bool
 
+	// Media types (e.g. "application/json", or "text/*" for any text) whose POST bodies are
+	// captured.  Bodies of other types are left unread, their events carrying just "content-type"
+	// and "request-bytes".  Empty (default) captures every type.
+	BodyContentTypes []string
+
+	// Fraction of POST bodies flattened, with FlattenPosts, to save the work on the rest; those
+	// carry only "request-bytes" (and "body-hash" with HashBody).  Every event then says whether
+	// its body was flattened in "body-flattened".  Zero flattens all.
+	FlattenSampleRate float64
+
+	// Whether POST bodies are recorded only as a SHA-256 hex "body-hash", e.g. for privacy or to
+	// recognize identical requests.  Bodies over MaxBodyBytes get no hash, only "body-truncated".
+	HashBody bool
+
+	// Whether hashed bodies are also stored or flattened as usual
+	HashBodyAlongside bool
+
+	// Whether gzip-encoded (per Content-Encoding) POST bodies are decompressed to be stored or
+	// flattened; the handler still reads them compressed
+	DecompressBodies bool
+
+	// Most bytes of a POST body read (and decompressed, with DecompressBodies), defaults to 1MB.
+	// The rest is left off, unread until the handler reads it, and "body-truncated" set; such a
+	// body is stored whole rather than flattened.
+	MaxBodyBytes int64
+
+	// Bodies stored whole (not flattened) longer than this many bytes are gzipped and base64-encoded
+	// into "body-gz" instead of "body".  Zero (default) always stores them raw.
+	CompressBodiesOver int
+
+	// Body handling per request media type (e.g. "application/json", or "image/*" for any image),
+	// in place of HashBody, HashBodyAlongside, and CompressBodiesOver, and optionally skipping them
+	// altogether.  Unlisted types are handled per those fields.
+	BodyPolicies map[string]BodyPolicy
+
+	// Decides from the final response status whether Middleware keeps the unflattened body ("body",
+	// or "body-gz" and "body-encoding"), e.g. only for failed requests.  Nil keeps it always.
+	KeepBodyForStatus func(status int) bool
+
 	// POST parameter formatting, defaults to DotStyle
 	FlattenStyle SeparatorStyle
 
-	host        string          // cache
-	skipParams  map[string]bool // cache
-	eventQueue  []string
-	queueBytes  int
-	events      chan string
-	batches     chan string
+	// Which moment the "timestamp" of Middleware events represents, defaults to ArrivalTimestamp
+	MiddlewareTimestamp TimestampStrategy
+
+	// Whether Middleware records an event for a panicking handler before re-panicking
+	RecoverPanics bool
+
+	// With RecoverPanics, whether the panic stops at Middleware instead, answered with a 500 unless
+	// the handler already wrote a response, e.g. without recovery middleware of one's own.
+	// http.ErrAbortHandler still continues up the stack.
+	SwallowPanics bool
+
+	// Whether recovered panics also carry a (truncated) "error-stack" -- a large attribute
+	CapturePanicStack bool
+
+	// Whether numbers are sent exactly as written: integers in flattened POST bodies keep full
+	// precision, and whole floats are sent as integers and other floats without exponents
+	PreciseNumbers bool
+
+	// Most attributes per event, defaults to (and can't exceed) New Relic's 254
+	MaxAttributes int
+
+	// Handling of events with more than MaxAttributes
+	ExtraAttributes AttributePolicy
+
+	// Handling of attribute values other than strings, numbers and booleans
+	UnsupportedValues ValuePolicy
+
+	// Attribute naming the integration that produced each event, e.g. "source": "http" for
+	// MakeEventFromRequest and Middleware, "grpc" for nrgrpc, "nrinsights" for the Connection's
+	// own, "manual" for the rest (see Event.SetSource).  An event already carrying it keeps its
+	// value.  Empty (default) sets none.
+	SourceAttribute string
+
+	// Handling of events that, marshaled, exceed New Relic's 5MB per call on their own
+	Oversized OversizePolicy
+
+	// String values longer than this many bytes are cut short, ending "…[truncated]", when an event
+	// is marshaled; defaults to New Relic's limit, 4096 (negative for no limit)
+	MaxValueBytes int
+
+	// Cleanup of string attribute values, applied when an event is marshaled (before MaxValueBytes)
+	SanitizeStrings SanitizeMode
+
+	// Whether an event that fails to marshal is still sent, with each unmarshalable value replaced
+	// by its fmt "%v" string, rather than RegisterEvent returning the error
+	MarshalFallback bool
+
+	// When set (e.g. 0.9), events reaching this fraction of MaxAttributes or MaxValueBytes (unless
+	// disabled) are reported, at most once a minute per event type: to OnLimitWarning if set,
+	// otherwise as an "InsightsLimitWarning" event
+	LimitWarningFraction float64
+
+	// Receives limit warnings in place of "InsightsLimitWarning" events
+	OnLimitWarning func(eventType string, attributes, largestValueBytes int)
+
+	// Whether RegisterEvent rejects events lacking an "eventType" or a positive numeric "timestamp"
+	StrictValidation bool
+
+	// With StrictValidation, how far from now (either way) a "timestamp" may be before RegisterEvent
+	// rejects the event, e.g. 24 hours for New Relic's ingestion window.  Zero allows any.
+	AllowedTimestampSkew time.Duration
+
+	// Whether a send interval with no events still sends an empty "[]" batch, e.g. as a heartbeat
+	SendEmptyBatches bool
+
+	// Whether Middleware sets a "correlation-id" on each event and in the request's context (see
+	// CorrelationId), taken from the CorrelationHeader when present, otherwise newly generated
+	CorrelationIds bool
+
+	// Incoming header carrying an existing correlation id, defaults to "X-Correlation-ID"
+	CorrelationHeader string
+
+	// Generates correlation ids, defaults to random (version 4) UUIDs
+	NewCorrelationId func() string
+
+	// gRPC metadata keys the nrgrpc interceptors capture as "md:<key>", multiple values joined with ","
+	GRPCMetadataToCapture []string
+
+	// Captured gRPC metadata keys whose values are replaced with "[redacted]"
+	GRPCMetadataToRedact []string
+
+	// Whether Middleware events carry a "handler" naming the wrapped handler, by reflection: its
+	// function name for http.HandlerFuncs, otherwise its type
+	RecordHandlerName bool
+
+	// Names the handler serving each request for "handler", in place of the reflected name
+	HandlerName func(r *http.Request) string
+
+	// Run on the request's context after the handler returns; when ok, Middleware sets "error-code",
+	// "error", and "error-type".  Values a handler adds with context.WithValue don't reach the
+	// middleware, so the context must already carry somewhere to put them -- RecordedError, with
+	// handlers calling RecordError, does that.
+	ErrorDetails func(ctx context.Context) (code, message, typ string, ok bool)
+
+	// Run on the request's context after the handler returns, like ErrorDetails; when ok,
+	// Middleware sets "downstream-retries" to the retries the handler made
+	DownstreamRetries func(ctx context.Context) (retries int, ok bool)
+
+	// Reports whether a request answered 404 matched no route, in which case Middleware records
+	// "url" as "<unmatched>" so scanners probing random paths don't add a url apiece
+	UnmatchedRoute func(r *http.Request) bool
+
+	// Whether Middleware drops the events of unmatched requests instead
+	SkipUnmatched bool
+
+	// Opts requests into per-route pre-aggregation by naming their route ("" opts out).  Aggregated
+	// routes emit one "AggregatedTransaction" event per route per send interval instead of one
+	// event per request.
+	AggregateRoute func(r *http.Request) string
+
+	// Whether aggregated routes also emit their per-request events
+	AggregateAlongside bool
+
+	// Reports whether registering an event should batch and send everything queued right away
+	// (e.g. for severity=critical), rather than at the next send interval
+	FlushPredicate func(e *Event) bool
+
+	// Attributes (e.g. "eventType" and "message") that, when identical across consecutive events
+	// in a queue, collapse those events into the first with a "repeat-count" of all of them.  Keeps
+	// log storms to one event per batch; a run cut by a flush carries on in the next batch's count.
+	// Events lacking any of these attributes never collapse; the rest are held to one attribute
+	// under MaxAttributes, leaving room for the count.
+	CollapseRepeats []string
+
+	// Called on each event as it's batched for sending, to add attributes only meaningful then
+	// (e.g. a load snapshot).  Runs on the batching goroutine, and must return quickly and never
+	// block.  Events are re-decoded to call it, with numbers as json.Numbers.
+	FlushEnricher func(e map[string]interface{})
+
+	// Groups events into separate queues, and so separate batches, per returned key (e.g. tenant or
+	// region).  Each queue batches early on its own, but all are flushed every send interval.  Every
+	// key holds its events in memory until then, so keys should be few.
+	BatchKey func(e *Event) string
+
+	// Most BatchKey queues held at once, defaults to 64; a new key beyond this flushes all queues
+	MaxBatchQueues int
+
+	// Most events the batching goroutine queues per wake-up, defaults to 128: those already waiting
+	// are taken back to back rather than each in its own select, then the tickers get their turn.
+	// Also sizes the buffer registrations wait in (at least 10 events).
+	CoalesceEvents int
+
+	// Called when a queue's events went out in several batches over one send interval, having
+	// neared New Relic's per-call limits, with the events and batches between them.  Runs on the
+	// batching goroutine, so it must return quickly.
+	OnSplit func(originalCount, resultingBatches int)
+
+	// Called with every batch dropped undelivered, e.g. to count or persist it: on the batching
+	// goroutine when the send queue is full, and otherwise on the sending or registering goroutine
+	// that dropped it (see Stats for the reasons).  It must return quickly.
+	OnDrop func(batch string, eventCount int)
+
+	// Called when batches waiting to be sent reach 80% of the queue's capacity (beyond which new
+	// batches are dropped), and again once they're back under 50%.  Runs on the batching goroutine,
+	// so it must return quickly.
+	OnBackpressure func(queued, capacity int)
+
+	// How often queued events are batched and sent, defaults to 60 seconds
+	SendInterval time.Duration
+
+	// Batches held waiting to be sent, e.g. while New Relic is unresponsive, before new ones are
+	// dropped; defaults to 20
+	SendQueueSize int
+
+	// Fraction (below 1) of New Relic's per-call limits, 1000 events or 5MB, at which a queue is
+	// batched early rather than at the send interval; defaults to 0.9
+	EarlyBatchFraction float64
+
+	// When set, the first batch is made this soon after Start rather than a full send interval
+	// later, so short-lived processes deliver promptly
+	InitialFlushDelay time.Duration
+
+	// Random extra delay, up to this, before that first batch -- spreading a fleet's first sends
+	InitialFlushJitter time.Duration
+
+	// Extra attempts StopAndFlush makes at batches its final send fails to deliver
+	ShutdownRetries int
+
+	// Directory the batches still unsent at shutdown are written to, one file each, to be loaded
+	// and resent by the next Start; a file is removed once its batch is sent.  Empty (default)
+	// keeps none.
+	SpoolDir string
+
+	// Bound on StopAndFlush's final send, retries included; zero means no bound beyond the fast
+	// per-request timeout
+	ShutdownTimeout time.Duration
+
+	// How often HighPriority events are batched, defaults to 5 seconds
+	HighPriorityInterval time.Duration
+
+	// Delay before resending a batch that failed to send, doubling with each failure up to the send
+	// interval; defaults to 1 second
+	RetryBackoff time.Duration
+
+	// Most resends of a batch before it's dropped, zero for no limit
+	MaxRetries int
+
+	// Most batches sent per send interval, to spread a backlog out rather than send it in a burst;
+	// the rest wait for later intervals.  Zero means no limit.  The final flush isn't limited.
+	MaxBatchesPerTick int
+
+	// Fraction of the send queue (SendQueueSize batches, waiting or unsent) past which the oldest
+	// NormalPriority unsent batches are dropped, keeping HighPriority ones longer.  Zero disables.
+	ExpireNormalAbove float64
+
+	// Approximate ceiling on bytes held across queued events and unsent batches; when exceeded the
+	// oldest batches are dropped first, then new events.  Zero means no limit.
+	MaxMemoryBytes int64
+
+	counters    *counters
+	insertKey   atomic.Value // string
+	paused      int32        // atomic
+	resumed     chan bool
+	aggregates  aggregator
+	warnings    limitWarnings
+	encoders    map[reflect.Type]Encoder
+	started     time.Time
+	host        string       // cache
+	commit      string       // cache
+	commitDirty bool         // cache
+	live        atomic.Value // *liveConfig, per UpdateConfig
+	queues      map[queueKey]*eventQueue
+	splits      map[queueKey]*split // queues batched early, with OnSplit
+	overloaded  bool                // as last reported to OnBackpressure
+	events      chan queuedEvent
+	warnEvents  chan queuedEvent // from checkLimits, never closed
+	typeFlushes chan typeFlush
+	flushReqs   chan chan bool // from Flush, to makeBatches
+	sendReqs    chan chan bool // from Flush, to sendBatches
+	flushes     chan bool      // from FlushPredicate
+	reconfig    chan bool      // from UpdateConfig, to makeBatches
+	repace      chan bool      // from UpdateConfig, to sendBatches
+	batches     chan *batch
+	highBatches chan *batch
+	closed      bool         // events is closed, by StopAndFlush
+	closeLock   sync.RWMutex // guards closed, held to send on events
 	eventsDone  chan bool
 	batchesDone chan bool
+	subscribers []chan []byte
+	subLock     sync.RWMutex // guards subscribers
 	unsent      *list.List
+	unsentLock  sync.Mutex
+	pacing      bool      // per MaxBatchesPerTick; sendBatches only
+	tickSends   int       // since the last interval, while pacing
+	final       bool      // in the final flush, which ignores RetryBackoff; sendBatches only
+	coolUntil   time.Time // no sends before, per a 429's Retry-After; sendBatches only
 	httpTimeout time.Duration
+	deadline    time.Time       // for sends, if not zero; used by the final flush
+	stopCtx     context.Context // from StopAndFlushContext, for the final flush
+	client      *http.Client
+	clock       clock // for the batching and retry timers; realClock unless a test sets another
 }
 
-type Event struct {
-	values map[string]interface{}
+// Receives a Connection's log messages, e.g. to route them into a structured logger.
+type Logger interface {
+	Printf(format string, args ...interface{})
 }
 
-func (e *Event) Set(name string, value interface{}) {
-	e.values[name] = value
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, args ...interface{}) {
+	log.Printf(format, args...)
 }
 
-func (c *Connection) Start() {
-	// skip param lookup
-	c.skipParams = make(map[string]bool)
-	for _, p := range c.QueryParamsToSkip {
-		c.skipParams[strings.ToLower(p)] = true
+func (c *Connection) log() Logger {
+	if c.Logger != nil {
+		return c.Logger
 	}
+	return stdLogger{}
+}
 
-	c.events = make(chan string, 10) // buffer a bit to amortize cost of batching under high load
-	c.batches = make(chan string, sendQueueSize)
-	c.eventsDone = make(chan bool, 1)
-	c.batchesDone = make(chan bool, 1)
-	c.unsent = list.New()
-	c.httpTimeout = defaultHttpTimeout
-
-	if hostname, err := os.Hostname(); err != nil {
-		c.host = "<unknown>"
-	} else {
-		c.host = hostname
-	}
+// Delivers batches of events, reusing the Connection's batching and resend.
+type Sender interface {
+	// Sends batch, a JSON array of event objects, to dest (which may be ignored).  A non-nil error
+	// keeps the batch queued for resend.  ctx carries the Connection's HTTP timeout.
+	Send(ctx context.Context, batch []byte, dest Destination) error
+}
 
-	if c.FlattenStyle == 0 {
-		c.FlattenStyle = DotStyle
-	}
+type Event struct {
+	values   map[string]interface{}
+	dest     Destination
+	priority Priority
 
-	go c.makeBatches()
-	go c.sendBatches()
+	conn   *Connection // nil for bare events
+	millis bool        // "timestamp" unit
+	source string      // for SourceAttribute
 }
 
-func (c *Connection) StopAndFlush() {
-	close(c.events)
-	<-c.eventsDone
-	close(c.batches)
-	<-c.batchesDone
+// An account to deliver an event to instead of the Connection's own.
+type Destination struct {
+	AccountId int
+
+	// Defaults to the Connection's InsightsAPIKey
+	InsightsAPIKey string
 }
 
-func (c *Connection) NewEvent() *Event {
-	var e Event
-	e.values = make(map[string]interface{})
+// A registered event, already marshaled, awaiting batching.
+type queuedEvent struct {
+	json      string
+	eventType string
+	dest      Destination
+	batchKey  string
+	priority  Priority
 
-	// defined by New Relic
-	e.Set("accountId", c.NewRelicAccountId)
-	if c.NewRelicAppId != 0 {
-		e.Set("appId", c.NewRelicAppId)
-	}
-	e.Set("eventType", "Transaction")
-	e.Set("timestamp", time.Now().Unix())
+	// Attribute count, checked against maxAttributes at batch assembly.
+	attributes int
 
-	e.Set("host", c.host)
+	// c.CollapseRepeats values, and how many identical events followed this one.
+	repeatKey string
+	repeats   int
+}
 
-	return &e
+type queueKey struct {
+	dest     Destination
+	batchKey string
+	priority Priority
 }
 
-// Create an event with values extracted from http.Request.  Sets "url" and "method".
-// For each query parameter, sets a "p:<key>" and the first value associated with <key> in the query.
-// If c.FlattenPosts is true, POST bodies are considered to be JSON strings and each key-value
-// pair sent separately.  (Any hierarchy in this JSON is flattened into a one-dimensional map with compound keys.)
-// If c.FlattenPosts is false (default), POST bodies are sent as a single "body" value.
-func (c *Connection) MakeEventFromRequest(r *http.Request) (*Event, error) {
-	e := c.NewEvent()
-	e.Set("url", r.URL.Path)
-	e.Set("method", r.Method)
+// Events awaiting batching that share a destination, BatchKey, and priority.
+type eventQueue struct {
+	dest     Destination
+	priority Priority
+	events   []queuedEvent
+	bytes    int
+}
 
-	qvalues := r.URL.Query()
-	for key := range qvalues {
-		if _, ok := c.skipParams[strings.ToLower(key)]; ok {
-			continue
-		}
-		e.Set("p:"+key, qvalues.Get(key))
-	}
+// The events and batches of a queue batched early, so far this interval.
+type split struct {
+	events  int
+	batches int
+}
 
-	if r.Method == "POST" {
-		bodybuf, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read request body: %v", err)
-		}
-		bodyreader := ioutil.NopCloser(bytes.NewBuffer(bodybuf))
-		r.Body = bodyreader
+// A batch of marshaled events awaiting delivery.
+type batch struct {
+	json     string
+	dest     Destination
+	priority Priority
+	events   int
+	shed     bool      // dropped from unsent for MaxMemoryBytes, guarded by unsentLock
+	gz       []byte    // json gzipped by the first send with Compress, for resends
+	failures int       // failed sends so far
+	retryAt  time.Time // no resend before, per RetryBackoff
+
+	spoolFile string // loaded from, in SpoolDir
+}
 
-		if c.FlattenPosts {
-			var nested, flat map[string]interface{}
+// Internal counters, updated atomically.
+type counters struct {
+	memoryBytes int64
+	dropped     [HighPriority + 1]int64 // events, by Priority
+	rejected    int64
+	skewed      int64
+	oversized   int64
+	registered  int64
+	sent        int64 // batches
+	failed      int64 // batch sends
+	queueDrops  int64 // batches
+}
 
-			err = json.Unmarshal(bodybuf, &nested)
-			if err != nil {
-				log.Printf("failed to unmarshal request json: %v; storing body as one string", err)
-				e.Set("body", string(bodybuf[:]))
-				goto done
-			}
+type Stats struct {
+	// Events queued by RegisterEvent and RegisterTyped, which block rather than drop while
+	// batching falls behind
+	EventsRegistered int64
 
-			flat, err = flatten.Flatten(nested, "p:", flatten.SeparatorStyle(c.FlattenStyle))
-			if err != nil {
-				log.Printf("failed to flatten request params: %v; storing body as one string", err)
-				e.Set("body", string(bodybuf[:]))
-				goto done
-			}
+	// Batches delivered (a 2xx response), and send attempts that failed, including non-2xx
+	// responses (each batch counting once per failure)
+	BatchesSent  int64
+	SendFailures int64
 
-			for k, v := range flat {
-				e.Set(k, v)
-			}
-		} else {
-			e.Set("body", string(bodybuf[:]))
-		}
+	// Batches dropped as made because the send queue was full
+	BatchesDropped int64
 
-	done:
-	}
+	// Approximate bytes held across queued events and unsent batches
+	MemoryBytes int64
 
-	return e, nil
-}
+	// Batches that have been tried and await resend (after StopAndFlush, those never delivered)
+	UnsentBatches int
 
-type Mutator func(r *http.Request, e *Event)
+	// Events dropped by priority, whatever the reason: MaxMemoryBytes, a full send queue,
+	// ExpireNormalAbove, MaxRetries, or the attribute limit
+	DroppedNormal int64
+	DroppedHigh   int64
 
-// Sets all the values from MakeEventFromRequest and adds call time "duration" in floating point seconds,
-// and resulting "status-code".
-func (c *Connection) Middleware(h http.Handler, fn Mutator) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		event, err := c.MakeEventFromRequest(r)
-		if err != nil {
-			log.Printf("insights middleware: failed to make event from request: %v", err)
-			h.ServeHTTP(w, r)
-			return
-		}
+	// Events the collector reported rejecting in otherwise successful sends, per RejectedEventsPath
+	RejectedEvents int64
 
-		if fn != nil {
-			fn(r, event)
-		}
+	// Events RegisterEvent rejected for a "timestamp" past AllowedTimestampSkew
+	SkewedEvents int64
+
+	// Events RegisterEvent rejected as too large for any batch, per Oversized
+	OversizedEvents int64
+}
 
-		start := time.Now()
-		captureWriter := &captureStatus{ResponseWriter: w, status: 200}
+// The outcome of one attempt to send a batch.
+type SendResult struct {
+	Destination Destination
+	Bytes       int
 
-		h.ServeHTTP(captureWriter, r)
+	// Whether the batch is done with; if not it stays queued for resend
+	Sent bool
 
-		event.Set("duration", time.Since(start).Seconds())
-		event.Set("status-code", captureWriter.status)
+	// The collector's response status, zero without a response or with a custom Sender
+	StatusCode int
 
-		c.RegisterEvent(event)
-	})
-}
+	Err      error
+	Duration time.Duration
 
-type captureStatus struct {
-	http.ResponseWriter
-	status int
+	// Timing phases, with c.TraceSends and the default sender
+	Trace *SendTrace
 }
 
-func (cs *captureStatus) WriteHeader(status int) {
-	cs.status = status
-	cs.ResponseWriter.WriteHeader(status)
+// A FlushType request, answered with the number of events flushed.
+type typeFlush struct {
+	eventType string
+	flushed   chan int
 }
 
-func (c *Connection) RegisterEvent(e *Event) error {
-	asjson, err := json.Marshal(e.values)
-	if err != nil {
-		return fmt.Errorf("could not marshal event: %v", err)
-	}
+func (e *Event) Set(name string, value interface{}) {
+	e.values[name] = value
+}
 
-	c.events <- string(asjson[:])
+// Returns the value of attribute name, and whether e has it.
+func (e *Event) Get(name string) (interface{}, bool) {
+	value, ok := e.values[name]
+	return value, ok
+}
 
-	return nil
+// Whether e has attribute name.
+func (e *Event) Has(name string) bool {
+	_, ok := e.values[name]
+	return ok
 }
 
-func (c *Connection) makeBatches() {
-	ticker := time.NewTicker(sendInterval)
+// Removes attribute name from e, e.g. from a Mutator redacting a captured param.
+func (e *Event) Delete(name string) {
+	delete(e.values, name)
+}
 
-outer:
-	for {
-		select {
-		case e, open := <-c.events:
-			if !open {
-				break outer
-			}
+// Routes e to another account, e.g. from a Mutator.  Events are batched per destination, and those
+// without one go to the Connection's account.
+func (e *Event) SetDestination(d Destination) {
+	e.dest = d
+	e.Set("accountId", d.AccountId)
+}
 
-			c.eventQueue = append(c.eventQueue, e)
-			c.queueBytes += len(e)
+// Sets e's "eventType", first checking it against New Relic's rules: up to 255 letters, digits,
+// ':' and '_', starting with a letter.  e is left unchanged if not.
+func (e *Event) SetEventType(eventType string) error {
+	if eventType == "" || len(eventType) > maxEventTypeLen {
+		return fmt.Errorf("invalid eventType %q: must be 1 to %d characters", eventType, maxEventTypeLen)
+	}
+	for i, r := range eventType {
+		letter := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+		if i == 0 && !letter {
+			return fmt.Errorf("invalid eventType %q: must start with a letter", eventType)
+		}
+		if !letter && !(r >= '0' && r <= '9') && r != ':' && r != '_' {
+			return fmt.Errorf("invalid eventType %q: %q isn't a letter, digit, ':' or '_'", eventType, r)
+		}
+	}
 
-			// If we're within 90% of New Relic space limits, batch early.
-			if len(c.eventQueue) > maxEventsPerCall*0.90 || c.queueBytes > maxSizePerCall*0.90 {
-				c.makeBatch()
+	e.Set("eventType", eventType)
+	if e.conn != nil {
+		if millis := e.conn.millisecondTimestamps(eventType); millis != e.millis {
+			at, converting := e.values["timestamp"].(int64)
+			at *= int64(e.timestampUnit())
+			e.millis = millis
+			if converting {
+				e.SetTimestamp(time.Unix(0, at))
 			}
-
-		case <-ticker.C:
-			c.makeBatch()
 		}
 	}
+	return nil
+}
 
-	c.makeBatch() // flush remaining
-	c.eventsDone <- true
+// Sets e's "timestamp", in place of its creation time, e.g. for a backfilled event.  The unit is
+// that of e's eventType (see TimestampMilliseconds).
+func (e *Event) SetTimestamp(t time.Time) {
+	e.Set("timestamp", t.UnixNano()/int64(e.timestampUnit()))
 }
 
-func (c *Connection) makeBatch() {
-	if len(c.eventQueue) == 0 {
-		return
+func (e *Event) timestampUnit() time.Duration {
+	if e.millis {
+		return time.Millisecond
 	}
+	return time.Second
+}
 
-	batch := "[" + strings.Join(c.eventQueue, ",") + "]"
-
-	select {
-	case c.batches <- batch:
-	default:
-	}
+// Sets which lane e is batched in, NormalPriority by default.
+func (e *Event) SetPriority(p Priority) {
+	e.priority = p
+}
 
-	c.eventQueue = nil
-	c.queueBytes = 0
+// Sets the integration e is attributed to under the Connection's SourceAttribute, "manual" by
+// default; for integrations outside this package.
+func (e *Event) SetSource(source string) {
+	e.source = source
 }
 
-func (c *Connection) sendBatches() {
-	for batch := range c.batches {
-		c.unsent.PushBack(batch)
-		c.sendUnsent()
+// Starts batching and sending events.  Returns an error, before starting anything, when events
+// couldn't be sent to Insights: without an InsightsAPIKey or a positive NewRelicAccountId (unless
+// a Sender delivers them elsewhere).  Start used to return nothing; callers ignoring the error
+// still compile.
+func (c *Connection) Start() error {
+	if c.Sender == nil {
+		if c.InsightsAPIKey == "" {
+			return fmt.Errorf("insights: InsightsAPIKey is required")
+		}
+		if c.NewRelicAccountId <= 0 {
+			return fmt.Errorf("insights: NewRelicAccountId must be positive, not %d", c.NewRelicAccountId)
+		}
 	}
 
+	if c.clock == nil {
+		c.clock = realClock{}
+	}
+	c.started = c.clock.Now()
+
+	c.events = make(chan queuedEvent, c.eventsBuffer())
+	c.warnEvents = make(chan queuedEvent, 10)
+	c.typeFlushes = make(chan typeFlush)
+	c.flushReqs = make(chan chan bool)
+	c.sendReqs = make(chan chan bool)
+	c.flushes = make(chan bool, 1)
+	c.reconfig = make(chan bool, 1)
+	c.repace = make(chan bool, 1)
+	c.queues = make(map[queueKey]*eventQueue)
+	c.splits = make(map[queueKey]*split)
+	c.batches = make(chan *batch, c.sendQueueSize())
+	c.highBatches = make(chan *batch, c.sendQueueSize())
+	c.eventsDone = make(chan bool, 1)
+	c.batchesDone = make(chan bool, 1)
+	c.resumed = make(chan bool, 1)
+	c.unsent = list.New()
+	c.counters = &counters{}
+	c.insertKey.Store(c.InsightsAPIKey)
+	c.httpTimeout = defaultHttpTimeout
+	c.client = c.HTTPClient
+	if c.client == nil {
+		c.client = &http.Client{Transport: c.newTransport(), Timeout: c.httpTimeout}
+	}
+
+	if hostname, err := os.Hostname(); err != nil {
+		c.host = "<unknown>"
+	} else {
+		c.host = hostname
+	}
+
+	if c.FlattenStyle == 0 {
+		c.FlattenStyle = DotStyle
+	}
+	c.live.Store(newLiveConfig(c.fieldConfig()))
+
+	if c.RecordCommit {
+		c.commit, c.commitDirty = buildCommit()
+	}
+
+	if c.UserAgent == "" {
+		c.UserAgent = "nrinsights-go/" + Version
+	}
+
+	if c.SpoolDir != "" && c.loadSpool() > 0 {
+		c.resumed <- true // to send them without waiting on new batches
+	}
+
+	go c.makeBatches()
+	go c.sendBatches()
+
+	if c.EmitStartupConfig {
+		c.RegisterEvent(c.startupConfigEvent())
+	}
+
+	return nil
+}
+
+// Encodes values of type t with fn from then on, in place of any built-in encoder (time.Time's
+// RFC 3339 string, time.Duration's seconds) or encoding/json's default.  Not safe to call alongside
+// RegisterEvent; register encoders before Start.
+func (c *Connection) RegisterEncoder(t reflect.Type, fn Encoder) {
+	if c.encoders == nil {
+		c.encoders = make(map[reflect.Type]Encoder)
+	}
+	c.encoders[t] = fn
+}
+
+// Replaces the Insights insert key used for subsequent sends, e.g. on rotation, without restarting.
+// Batches routed to a Destination with its own key are unaffected.
+func (c *Connection) SetInsertKey(key string) {
+	c.insertKey.Store(key)
+}
+
+// Stops sending to New Relic, e.g. for a maintenance window, while events keep being accepted and
+// batched.  Unsent batches accumulate in memory, so consider MaxMemoryBytes.  StopAndFlush still
+// makes its final send.
+func (c *Connection) Pause() {
+	atomic.StoreInt32(&c.paused, 1)
+}
+
+// Resumes sending after Pause, starting with the batches held meanwhile.
+func (c *Connection) Resume() {
+	atomic.StoreInt32(&c.paused, 0)
+
+	select {
+	case c.resumed <- true:
+	default: // a drain is already pending
+	}
+}
+
+func (c *Connection) isPaused() bool {
+	return atomic.LoadInt32(&c.paused) == 1
+}
+
+// The VCS revision go build embedded, if any, and whether the tree had uncommitted changes.
+func buildCommit() (string, bool) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", false
+	}
+
+	var revision string
+	var dirty bool
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			dirty = setting.Value == "true"
+		}
+	}
+	return revision, dirty
+}
+
+// A transport with c's pool tuning and pinning, shared by every send.
+func (c *Connection) newTransport() http.RoundTripper {
+	var t *http.Transport
+	if base, ok := http.DefaultTransport.(*http.Transport); ok {
+		t = base.Clone()
+	} else if len(c.PinnedCertFingerprints) > 0 {
+		t = &http.Transport{Proxy: http.ProxyFromEnvironment} // pins mustn't be silently skipped
+	} else {
+		return http.DefaultTransport // replaced by the application; leave it be
+	}
+
+	if c.MaxIdleConns > 0 {
+		t.MaxIdleConns = c.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	if c.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = c.IdleConnTimeout
+	}
+
+	if len(c.PinnedCertFingerprints) > 0 {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.VerifyPeerCertificate = verifyPinned(c.PinnedCertFingerprints)
+	}
+
+	return t
+}
+
+// Accepts a chain (already verified as usual) only if one of its certificates matches a pin.
+func verifyPinned(fingerprints []string) func([][]byte, [][]*x509.Certificate) error {
+	pins := make(map[string]bool)
+	for _, fp := range fingerprints {
+		pins[strings.ToLower(strings.Replace(fp, ":", "", -1))] = true
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			sum := sha256.Sum256(raw)
+			if pins[hex.EncodeToString(sum[:])] {
+				return nil
+			}
+		}
+		return fmt.Errorf("insights: collector certificate matches no pinned fingerprint")
+	}
+}
+
+// Sends everything queued and stops.  RegisterEvent returns ErrConnectionClosed from then on.
+func (c *Connection) StopAndFlush() {
+	c.StopAndFlushContext(context.Background())
+}
+
+// Like StopAndFlush, but gives up on the final sends once ctx is done, returning an error naming
+// how many batches were left unsent (Stats still reports them); ShutdownTimeout applies as well
+// if sooner.  Shutdown then finishes in the background, without further sends.
+func (c *Connection) StopAndFlushContext(ctx context.Context) error {
+	c.closeLock.Lock()
+	c.closed = true
+	c.stopCtx = ctx // seen by the final flush, which follows close
+	close(c.events)
+	c.closeLock.Unlock()
+
+	stopped := make(chan bool)
+	go func() {
+		<-c.eventsDone
+		close(c.batches)
+		close(c.highBatches)
+		<-c.batchesDone
+
+		c.subLock.Lock()
+		for _, ch := range c.subscribers {
+			close(ch)
+		}
+		c.subscribers = nil
+		c.subLock.Unlock()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		if n := c.unsentLen(); n > 0 && ctx.Err() != nil {
+			return fmt.Errorf("insights: shutdown cut short: %v; %d batches unsent", ctx.Err(), n)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("insights: shutdown cut short: %v; %d batches unsent", ctx.Err(), c.unsentLen())
+	}
+}
+
+// Returns a channel receiving every event registered from then on, marshaled as sent, e.g. for a
+// local debug view.  Each subscriber gets its own channel, buffering a few hundred events; while
+// it's full, events are dropped for that subscriber alone rather than holding up registration.
+// Subscribers share each event's bytes, so mustn't modify them.  Channels are closed by
+// StopAndFlush.
+func (c *Connection) Subscribe() <-chan []byte {
+	ch := make(chan []byte, subscriberBuffer)
+	c.subLock.Lock()
+	c.subscribers = append(c.subscribers, ch)
+	c.subLock.Unlock()
+	return ch
+}
+
+// Hands event to every subscriber with room for it, once it's queued.
+func (c *Connection) publish(event string) {
+	c.subLock.RLock()
+	defer c.subLock.RUnlock()
+	if len(c.subscribers) == 0 {
+		return
+	}
+	asbytes := []byte(event)
+	for _, ch := range c.subscribers {
+		select {
+		case ch <- asbytes:
+		default:
+		}
+	}
+}
+
+func (c *Connection) NewEvent() *Event {
+	var e Event
+	e.values = make(map[string]interface{})
+
+	// defined by New Relic
+	e.Set("accountId", c.NewRelicAccountId)
+	if c.NewRelicAppId != 0 {
+		e.Set("appId", c.NewRelicAppId)
+	}
+	if c.AppName != "" {
+		e.Set("appName", c.AppName)
+	}
+	eventType := c.EventType
+	if eventType == "" {
+		eventType = "Transaction"
+	}
+	e.Set("eventType", eventType)
+	e.conn = c
+	e.millis = c.millisecondTimestamps(eventType)
+	e.SetTimestamp(time.Now())
+
+	e.Set("host", c.host)
+	if c.commit != "" {
+		e.Set("commit", c.commit)
+		e.Set("commit-dirty", c.commitDirty)
+	}
+	if c.ServerRegion != "" {
+		e.Set("region", c.ServerRegion)
+	}
+	if c.ServerZone != "" {
+		e.Set("zone", c.ServerZone)
+	}
+	if c.RecordUptime {
+		e.Set("uptime-seconds", int64(c.now().Sub(c.started).Seconds()))
+	}
+
+	return &e
+}
+
+// Create an event with no attributes at all, not even those New Relic requires -- the caller
+// must set "eventType" and "timestamp".
+func (c *Connection) NewBareEvent() *Event {
+	return &Event{values: make(map[string]interface{})}
+}
+
+// Create an event with values extracted from http.Request.  Sets "url", "method" and "clientIp"
+// (see c.TrustProxyHeaders), and with c.CaptureContentTypes, "content-type" and "accept".
+// For each query parameter, sets a "p:<key>" (see c.ParamPrefix) and the first value associated with <key> in the query
+// (or with c.MultiValueParams, all of them).
+// If c.FlattenPosts is true, JSON POST bodies (by Content-Type) have each key-value pair sent
+// separately, and form bodies each field.  (Any hierarchy in this JSON is flattened into a one-dimensional map with compound keys.)
+// If c.FlattenPosts is false (default), POST bodies are sent as a single "body" value (see c.CompressBodiesOver).
+// If c.HashBody is true, POST bodies are sent as a "body-hash" instead, or as well with c.HashBodyAlongside.
+// POST bodies c.ShouldCaptureBody declines, or of types c.BodyContentTypes lacks, are left unread.  c.BodyPolicies can vary all this by
+// Content-Type.
+func (c *Connection) MakeEventFromRequest(r *http.Request) (*Event, error) {
+	e := c.NewEvent()
+	e.SetSource("http")
+	e.Set("url", r.URL.Path)
+	e.Set("method", r.Method)
+	if ip := c.clientIP(r); ip != "" {
+		e.Set("clientIp", ip)
+	}
+
+	if c.CaptureContentTypes {
+		c.setContentTypes(e, r.Header)
+	}
+	if c.CaptureTLS && r.TLS != nil && r.TLS.ServerName != "" {
+		e.Set("tls-sni", r.TLS.ServerName)
+	}
+	for _, header := range c.HeadersToCapture {
+		if values, ok := r.Header[http.CanonicalHeaderKey(header)]; ok {
+			e.Set("h:"+header, strings.Join(values, ","))
+		}
+	}
+
+	policy := c.bodyPolicy(r)
+	contentType := mediaType(r.Header.Get("Content-Type"))
+	captureBody := r.Method == "POST" && !policy.Skip && (c.ShouldCaptureBody == nil || c.ShouldCaptureBody(r))
+	if captureBody && len(c.BodyContentTypes) > 0 && !mediaTypeIn(contentType, c.BodyContentTypes) {
+		captureBody = false
+		e.Set("content-type", contentType)
+		e.Set("request-bytes", max64(r.ContentLength, 0))
+	}
+	if c.CaptureSizes && !captureBody {
+		e.Set("request-bytes", max64(r.ContentLength, 0)) // -1 when unknown
+	}
+
+	cfg := c.config()
+	qvalues := r.URL.Query()
+	keys := make([]string, 0, len(qvalues))
+	for key := range qvalues {
+		if _, ok := cfg.skipParams[strings.ToLower(key)]; ok {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if max := cfg.maxQueryParams(); max >= 0 && len(keys) > max {
+		sort.Strings(keys)
+		c.log().Printf("insights MakeEventFromRequest: %d query params over MaxQueryParams (%d) left off", len(keys)-max, max)
+		e.Set("query-params-truncated", true)
+		keys = keys[:max]
+	}
+	c.setParams(e, qvalues, keys, cfg)
+
+	if captureBody {
+		flattenBody := cfg.FlattenPosts && (contentType == "application/json" || strings.HasSuffix(contentType, "+json"))
+		formBody := cfg.FlattenPosts && (contentType == "application/x-www-form-urlencoded" || contentType == "multipart/form-data")
+
+		var body io.Reader = r.Body
+		var hasher hash.Hash
+		if policy.Hash {
+			hasher = sha256.New()
+			body = io.TeeReader(r.Body, hasher)
+		}
+
+		// One byte past the limit, to tell a body of exactly the limit from a longer one.
+		limit := cfg.maxBodyBytes()
+		bodybuf, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %v", err)
+		}
+		truncated := int64(len(bodybuf)) > limit
+		if truncated {
+			// the handler still gets all of it: what was read, then the rest
+			r.Body = replayedBody{io.MultiReader(bytes.NewReader(bodybuf), r.Body), r.Body}
+			bodybuf = bodybuf[:limit]
+			e.Set("body-truncated", true)
+		} else {
+			bodyreader := ioutil.NopCloser(bytes.NewBuffer(bodybuf))
+			r.Body = bodyreader
+		}
+
+		if c.CaptureSizes {
+			if truncated && r.ContentLength > 0 {
+				e.Set("request-bytes", r.ContentLength)
+			} else {
+				e.Set("request-bytes", int64(len(bodybuf)))
+			}
+		}
+
+		hashed := !truncated // else the hasher saw only the part read
+		if c.DecompressBodies && !truncated && strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+			var decompressed []byte
+			if decompressed, truncated, err = gunzip(bodybuf, limit); err != nil {
+				c.log().Printf("insights MakeEventFromRequest: failed to decompress gzip body: %v; storing it compressed", err)
+			} else {
+				bodybuf = decompressed
+				if truncated {
+					e.Set("body-truncated", true)
+				}
+			}
+		}
+
+		if policy.Hash {
+			if hashed {
+				e.Set("body-hash", hex.EncodeToString(hasher.Sum(nil)))
+			}
+			if !policy.HashAlongside {
+				goto done
+			}
+		}
+
+		if truncated {
+			flattenBody, formBody = false, false // the JSON or form is cut off
+		}
+		if (flattenBody || formBody) && cfg.FlattenSampleRate > 0 {
+			sampled := mathrand.Float64() < cfg.FlattenSampleRate
+			e.Set("body-flattened", sampled)
+			if !sampled {
+				e.Set("request-bytes", int64(len(bodybuf)))
+				goto done
+			}
+		}
+
+		if formBody {
+			if err = c.setFormParams(e, r.Header.Get("Content-Type"), bodybuf, cfg); err != nil {
+				c.log().Printf("failed to parse request form: %v; storing body as one string", err)
+				cfg.unflattened(e)
+				c.setBody(e, bodybuf, policy.CompressOver)
+			}
+		} else if flattenBody {
+			var nested, flat map[string]interface{}
+
+			dec := json.NewDecoder(bytes.NewReader(bodybuf))
+			if c.PreciseNumbers {
+				dec.UseNumber() // rather than float64, which loses integer precision past 2^53
+			}
+			err = dec.Decode(&nested)
+			if err != nil {
+				c.log().Printf("failed to unmarshal request json: %v; storing body as one string", err)
+				cfg.unflattened(e)
+				c.setBody(e, bodybuf, policy.CompressOver)
+				goto done
+			}
+
+			flat, err = flatten.Flatten(nested, c.paramPrefix(), flatten.SeparatorStyle(cfg.FlattenStyle))
+			if err != nil {
+				c.log().Printf("failed to flatten request params: %v; storing body as one string", err)
+				cfg.unflattened(e)
+				c.setBody(e, bodybuf, policy.CompressOver)
+				goto done
+			}
+
+			for k, v := range flat {
+				if cfg.redactParams[strings.ToLower(strings.TrimPrefix(k, c.paramPrefix()))] {
+					v = c.redacted(fmt.Sprint(v))
+				}
+				e.Set(k, v)
+			}
+		} else {
+			c.setBody(e, bodybuf, policy.CompressOver)
+		}
+
+	done:
+	}
+
+	return e, nil
+}
+
+// Returns r's client address, without a port, preferring proxy headers with c.TrustProxyHeaders.
+func (c *Connection) clientIP(r *http.Request) string {
+	if c.TrustProxyHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			if i := strings.IndexByte(forwarded, ','); i >= 0 {
+				forwarded = forwarded[:i]
+			}
+			return strings.TrimSpace(forwarded)
+		}
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return strings.TrimSpace(realIP)
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr // no port
+}
+
+// Sets a param attribute (see ParamPrefix) per each of keys in values, with its first value or,
+// with c.MultiValueParams, all of them, redacted per cfg.
+func (c *Connection) setParams(e *Event, values url.Values, keys []string, cfg *liveConfig) {
+	for _, key := range keys {
+		value := values.Get(key)
+		if c.MultiValueParams {
+			value = strings.Join(values[key], ",")
+		}
+		if cfg.redactParams[strings.ToLower(key)] {
+			value = c.redacted(value)
+		}
+		e.Set(c.paramPrefix()+key, value)
+	}
+}
+
+// Returns what a redacted param's value is replaced by: "[redacted]", or with
+// c.HashRedactedParams, value's SHA-256 hex.
+func (c *Connection) redacted(value string) string {
+	if c.HashRedactedParams {
+		sum := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(sum[:])
+	}
+	return "[redacted]"
+}
+
+// Sets the fields of a form body, URL-encoded or multipart per contentType, as query params are
+// set.  Multipart file parts are left out.
+func (c *Connection) setFormParams(e *Event, contentType string, body []byte, cfg *liveConfig) error {
+	var values url.Values
+	if mediaType(contentType) == "multipart/form-data" {
+		_, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return err
+		}
+		form, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(int64(len(body)))
+		if err != nil {
+			return err
+		}
+		defer form.RemoveAll()
+		values = url.Values(form.Value)
+	} else {
+		var err error
+		if values, err = url.ParseQuery(string(body)); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if _, ok := cfg.skipParams[strings.ToLower(key)]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	c.setParams(e, values, keys, cfg)
+	return nil
+}
+
+// Notes that a sampled body couldn't be flattened after all.
+func (cfg *liveConfig) unflattened(e *Event) {
+	if cfg.FlattenSampleRate > 0 {
+		e.Set("body-flattened", false)
+	}
+}
+
+func (c *Connection) setContentTypes(e *Event, header http.Header) {
+	for _, h := range []struct{ name, attr string }{{"Content-Type", "content-type"}, {"Accept", "accept"}} {
+		raw := strings.Join(header[h.name], ",")
+		if raw == "" {
+			continue
+		}
+
+		types := strings.Split(raw, ",")
+		for i, t := range types {
+			types[i] = mediaType(t)
+		}
+		e.Set(h.attr, strings.Join(types, ","))
+		if c.RawContentTypes {
+			e.Set(h.attr+"-raw", raw)
+		}
+	}
+}
+
+// Returns t, lowercased, without its parameters.
+func mediaType(t string) string {
+	if i := strings.IndexByte(t, ';'); i >= 0 {
+		t = t[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+func (c *Connection) millisecondTimestamps(eventType string) bool {
+	if millis, ok := c.TimestampMilliseconds[eventType]; ok {
+		return millis
+	}
+	return c.MillisecondTimestamps
+}
+
+func (cfg *liveConfig) maxBodyBytes() int64 {
+	if max := cfg.MaxBodyBytes; max > 0 {
+		return max
+	}
+	return defaultMaxBodyBytes
+}
+
+// A request body partly read ahead, closing the original.
+type replayedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Decompresses body, up to limit bytes, reporting whether there was more.
+func gunzip(body []byte, limit int64) (decompressed []byte, truncated bool, err error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	defer zr.Close()
+
+	// One byte past the limit, to tell a body of exactly limit bytes from a longer one; reading no
+	// further than that keeps a small "gzip bomb" from inflating into a huge buffer.
+	decompressed, err = ioutil.ReadAll(io.LimitReader(zr, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(decompressed)) > limit {
+		return decompressed[:limit], true, nil
+	}
+	return decompressed, false, nil
+}
+
+func (c *Connection) paramPrefix() string {
+	if c.ParamPrefix != "" {
+		return c.ParamPrefix
+	}
+	return "p:"
+}
+
+func (cfg *liveConfig) maxQueryParams() int {
+	if max := cfg.MaxQueryParams; max != 0 {
+		return max
+	}
+	return defaultMaxQueryParams
+}
+
+// Sets the c.GRPCMetadataToCapture keys present in md (e.g. a grpc metadata.MD) on e.
+func (c *Connection) SetMetadata(e *Event, md map[string][]string) {
+	for _, key := range c.GRPCMetadataToCapture {
+		key = strings.ToLower(key) // as metadata keys are stored
+		values, ok := md[key]
+		if !ok {
+			continue
+		}
+
+		value := strings.Join(values, ",")
+		for _, redact := range c.GRPCMetadataToRedact {
+			if strings.ToLower(redact) == key {
+				value = "[redacted]"
+				break
+			}
+		}
+		e.Set("md:"+key, value)
+	}
+}
+
+// Stores body as a single "body" value, or compressed as "body-gz" per c.CompressBodiesOver.
+func (c *Connection) setBody(e *Event, body []byte, compressOver int) {
+	if compressOver > 0 && len(body) > compressOver {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(body)
+		if err == nil {
+			err = zw.Close()
+		}
+		if err == nil {
+			e.Set("body-gz", base64.StdEncoding.EncodeToString(buf.Bytes()))
+			e.Set("body-encoding", "gzip+base64")
+			return
+		}
+		c.log().Printf("failed to compress request body: %v; storing body uncompressed", err)
+	}
+
+	e.Set("body", string(body[:]))
+}
+
+// How MakeEventFromRequest captures POST bodies of one media type (see Connection.BodyPolicies).
+type BodyPolicy struct {
+	// Whether these bodies are left unread, as if ShouldCaptureBody declined them
+	Skip bool
+
+	// As Connection.HashBody and HashBodyAlongside
+	Hash          bool
+	HashAlongside bool
+
+	// As Connection.CompressBodiesOver
+	CompressOver int
+}
+
+// The BodyPolicy for r's Content-Type, from c.BodyPolicies or else c's own fields.
+func (c *Connection) bodyPolicy(r *http.Request) BodyPolicy {
+	if len(c.BodyPolicies) > 0 {
+		t := mediaType(r.Header.Get("Content-Type"))
+		if policy, ok := c.BodyPolicies[t]; ok {
+			return policy
+		}
+		if policy, ok := c.BodyPolicies[wildcardType(t)]; ok {
+			return policy
+		}
+	}
+	return BodyPolicy{Hash: c.HashBody, HashAlongside: c.HashBodyAlongside, CompressOver: c.CompressBodiesOver}
+}
+
+// Whether media type t is one of types, or matches a "type/*" among them.
+func mediaTypeIn(t string, types []string) bool {
+	for _, candidate := range types {
+		candidate = mediaType(candidate)
+		if candidate == t || candidate == wildcardType(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns "type/*" for t's type, or "" for one without a '/'.
+func wildcardType(t string) string {
+	if i := strings.IndexByte(t, '/'); i >= 0 {
+		return t[:i] + "/*"
+	}
+	return ""
+}
+
+type Mutator func(r *http.Request, e *Event)
+
+// Sets all the values from MakeEventFromRequest, then those from SetResponse once the handler
+// returns.  With c.RecoverPanics, a panicking handler's event is still registered (see setPanic)
+// and the panic then continues up the stack, or with c.SwallowPanics, ends there.  Requests c.AggregateRoute names are folded into
+// their route's aggregate instead (see queueAggregates).  With c.CorrelationIds, fn and h see the
+// request with its correlation id in context.  A panic in fn is recovered and "mutator-panicked"
+// set, leaving the request to be served.  "url" is settled only once the status is known, so
+// c.UnmatchedRoute can collapse 404s for unrouted paths.
+func (c *Connection) Middleware(h http.Handler, fn Mutator) http.Handler {
+	var name string
+	if c.RecordHandlerName {
+		name = handlerName(h) // once, rather than reflecting per request
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event, err := c.MakeEventFromRequest(r)
+		if err != nil {
+			c.log().Printf("insights middleware: failed to make event from request: %v", err)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if c.CorrelationIds {
+			r = c.withCorrelationId(r, event)
+		}
+
+		if c.ErrorDetails != nil {
+			r = r.WithContext(context.WithValue(r.Context(), errorSlotKey{}, &errorSlot{}))
+		}
+
+		if c.HandlerName != nil {
+			event.Set("handler", c.HandlerName(r))
+		} else if name != "" {
+			event.Set("handler", name)
+		}
+
+		if fn != nil {
+			c.mutate(fn, r, event)
+		}
+
+		var route string
+		if c.AggregateRoute != nil {
+			route = c.AggregateRoute(r)
+		}
+
+		rec := NewResponseRecorder(w)
+
+		finish := func() {
+			end := time.Now()
+			c.setResponse(event, rec, end)
+			if c.ErrorDetails != nil {
+				if code, message, typ, ok := c.ErrorDetails(r.Context()); ok {
+					event.Set("error-code", code)
+					event.Set("error", message)
+					event.Set("error-type", typ)
+				}
+			}
+			if c.DownstreamRetries != nil {
+				if retries, ok := c.DownstreamRetries(r.Context()); ok {
+					event.Set("downstream-retries", retries)
+				}
+			}
+			if c.KeepBodyForStatus != nil && !c.KeepBodyForStatus(rec.status) {
+				delete(event.values, "body")
+				delete(event.values, "body-gz")
+				delete(event.values, "body-encoding")
+			}
+			if c.UnmatchedRoute != nil && rec.status == http.StatusNotFound && c.UnmatchedRoute(r) {
+				if c.SkipUnmatched {
+					return
+				}
+				event.Set("url", unmatchedURL)
+			}
+
+			if route != "" {
+				c.aggregates.add(route, end.Sub(rec.start).Seconds(), rec.status)
+				if !c.AggregateAlongside {
+					return
+				}
+			}
+
+			c.RegisterEvent(event) // an error (even ErrConnectionClosed, mid-shutdown) only loses the event
+		}
+
+		if c.RecoverPanics {
+			defer func() {
+				if v := recover(); v != nil {
+					swallow := c.SwallowPanics && v != http.ErrAbortHandler
+					if !rec.wroteHeader {
+						if swallow {
+							http.Error(rec, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+						} else {
+							rec.status = http.StatusInternalServerError
+						}
+					}
+					c.setPanic(event, v)
+					finish()
+					if !swallow {
+						panic(v)
+					}
+				}
+			}()
+		}
+
+		h.ServeHTTP(rec, r)
+
+		finish()
+	})
+}
+
+// Runs fn, recovering any panic in it so event is still registered with what fn had set.
+func (c *Connection) mutate(fn Mutator, r *http.Request, e *Event) {
+	defer func() {
+		if v := recover(); v != nil {
+			c.log().Printf("insights middleware: mutator panicked: %v", v)
+			e.Set("mutator-panicked", true)
+		}
+	}()
+	fn(r, e)
+}
+
+func handlerName(h http.Handler) string {
+	if v := reflect.ValueOf(h); v.Kind() == reflect.Func {
+		if f := runtime.FuncForPC(v.Pointer()); f != nil {
+			return f.Name()
+		}
+	}
+	return fmt.Sprintf("%T", h)
+}
+
+type errorSlotKey struct{}
+
+type errorSlot struct {
+	lock               sync.Mutex
+	set                bool
+	code, message, typ string
+}
+
+// Records an error for Middleware to put on the request's event, when c.ErrorDetails is
+// RecordedError.  ctx is the request's context, or one derived from it.
+func RecordError(ctx context.Context, code, message, typ string) {
+	if slot, ok := ctx.Value(errorSlotKey{}).(*errorSlot); ok {
+		slot.lock.Lock()
+		slot.set, slot.code, slot.message, slot.typ = true, code, message, typ
+		slot.lock.Unlock()
+	}
+}
+
+// Reports the error last passed to RecordError, for use as c.ErrorDetails.
+func RecordedError(ctx context.Context) (code, message, typ string, ok bool) {
+	slot, found := ctx.Value(errorSlotKey{}).(*errorSlot)
+	if !found {
+		return "", "", "", false
+	}
+
+	slot.lock.Lock()
+	defer slot.lock.Unlock()
+	return slot.code, slot.message, slot.typ, slot.set
+}
+
+type correlationIdKey struct{}
+
+// Returns the correlation id Middleware stored in ctx, or "" if none.
+func CorrelationId(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIdKey{}).(string)
+	return id
+}
+
+// Sets e's "correlation-id", reusing the incoming one if present, and returns r carrying it in its context.
+func (c *Connection) withCorrelationId(r *http.Request, e *Event) *http.Request {
+	header := c.CorrelationHeader
+	if header == "" {
+		header = "X-Correlation-ID"
+	}
+
+	id := r.Header.Get(header)
+	if id == "" {
+		if c.NewCorrelationId != nil {
+			id = c.NewCorrelationId()
+		} else {
+			id = c.newUUID()
+		}
+	}
+
+	e.Set("correlation-id", id)
+	return r.WithContext(context.WithValue(r.Context(), correlationIdKey{}, id))
+}
+
+// A random (version 4) UUID.
+func (c *Connection) newUUID() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		c.log().Printf("insights: failed to generate uuid: %v", err)
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// Records a recovered panic value on e as "panicked", "error" and "error-type", plus "error-stack"
+// if c.CapturePanicStack.
+func (c *Connection) setPanic(e *Event, v interface{}) {
+	e.Set("panicked", true)
+	e.Set("error", truncateString(fmt.Sprint(v), maxValueBytes))
+
+	switch v.(type) {
+	case runtime.Error:
+		e.Set("error-type", "runtime")
+	case error:
+		e.Set("error-type", "error")
+	default:
+		e.Set("error-type", "value")
+	}
+
+	if c.CapturePanicStack {
+		e.Set("error-stack", truncateString(string(debug.Stack()), maxValueBytes))
+	}
+}
+
+// Shortens s to at most n bytes without splitting a UTF-8 sequence.
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Queues e to be batched and sent.  Returns ErrNotStarted before Start and ErrConnectionClosed
+// after StopAndFlush.
+func (c *Connection) RegisterEvent(e *Event) error {
+	if c.counters == nil {
+		return ErrNotStarted
+	}
+	qe, err := c.prepareEvent(e)
+	if err != nil {
+		return err
+	}
+	flush := c.FlushPredicate != nil && c.FlushPredicate(e)
+
+	if err := c.enqueue(qe); err != nil {
+		return err
+	}
+
+	if flush {
+		select {
+		case c.flushes <- true:
+		default: // a flush is already pending, and will take this event
+		}
+	}
+
+	return nil
+}
+
+// Registers v, a struct (or anything else marshaling to a JSON object), marshaled as is: no
+// values are transformed or checked, and none are added, so v must carry "eventType" and
+// "timestamp" itself, along with whatever else NewEvent would set.  For high-volume events with
+// fixed fields, this skips building an Event's map.  Typed events are batched and sent like any
+// other, at NormalPriority to the Connection's own account.
+func (c *Connection) RegisterTyped(v interface{}) error {
+	if c.counters == nil {
+		return ErrNotStarted
+	}
+	asjson, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("could not marshal event: %v", err)
+	}
+	if len(asjson) == 0 || asjson[0] != '{' {
+		return fmt.Errorf("invalid event: %T doesn't marshal to a JSON object", v)
+	}
+
+	if !c.reserveMemory(len(asjson)) {
+		c.countDropped(NormalPriority, 1)
+		return fmt.Errorf("event dropped: MaxMemoryBytes (%d) exceeded", c.MaxMemoryBytes)
+	}
+	return c.enqueue(queuedEvent{json: string(asjson)})
+}
+
+// Hands qe to the batching goroutine, unless StopAndFlush has begun.
+func (c *Connection) enqueue(qe queuedEvent) error {
+	c.closeLock.RLock()
+	defer c.closeLock.RUnlock()
+
+	if c.closed {
+		c.releaseMemory(len(qe.json))
+		return ErrConnectionClosed
+	}
+	c.events <- qe
+	atomic.AddInt64(&c.counters.registered, 1)
+	c.publish(qe.json)
+	return nil
+}
+
+// Validates and marshals e, reserving memory for it.
+func (c *Connection) prepareEvent(e *Event) (queuedEvent, error) {
+	if c.SourceAttribute != "" {
+		if _, ok := e.values[c.SourceAttribute]; !ok {
+			source := e.source
+			if source == "" {
+				source = "manual"
+			}
+			e.Set(c.SourceAttribute, source)
+		}
+	}
+
+	if c.StrictValidation {
+		if err := c.validateEvent(e); err != nil {
+			return queuedEvent{}, err
+		}
+	}
+
+	if c.LimitWarningFraction > 0 {
+		c.checkLimits(e)
+	}
+
+	values := c.encodeValues(e.values)
+	values = c.coerceValues(values)
+	if c.PreciseNumbers {
+		values = preciseNumbers(values)
+	}
+	if c.SanitizeStrings != LeaveControlChars {
+		values = sanitizeValues(values, c.SanitizeStrings)
+	}
+	if limit := c.maxValueBytes(); limit > 0 {
+		values = truncateValues(values, limit)
+	}
+	limit := c.maxAttributes()
+	if len(c.CollapseRepeats) > 0 && c.repeatKey(values) != "" {
+		limit-- // room for a collapsed run's repeat-count
+	}
+	if len(values) > limit {
+		if c.ExtraAttributes != DropExtraAttributes {
+			return queuedEvent{}, fmt.Errorf("invalid event: %d attributes, over MaxAttributes (%d)", len(values), limit)
+		}
+		var dropped []string
+		values, dropped = dropExtraAttributes(values, limit)
+		c.log().Printf("insights RegisterEvent: dropped %d attributes over MaxAttributes (%d): %s", len(dropped), limit, strings.Join(dropped, ", "))
+	}
+
+	asjson, err := json.Marshal(values)
+	if err != nil && c.MarshalFallback {
+		c.log().Printf("insights RegisterEvent: could not marshal event: %v; stringifying unmarshalable values", err)
+		values = stringifyUnmarshalable(values)
+		asjson, err = json.Marshal(values)
+	}
+	if err != nil {
+		return queuedEvent{}, fmt.Errorf("could not marshal event: %v", err)
+	}
+
+	limit = maxSizePerCall - len("[]")
+	for len(asjson) > limit && c.Oversized == TruncateOversized {
+		var ok bool
+		if values, ok = truncateLargest(values, len(asjson)-limit); !ok {
+			break
+		}
+		if asjson, err = json.Marshal(values); err != nil {
+			return queuedEvent{}, fmt.Errorf("could not marshal event: %v", err)
+		}
+	}
+	if len(asjson) > limit {
+		atomic.AddInt64(&c.counters.oversized, 1)
+		return queuedEvent{}, fmt.Errorf("event dropped: %d bytes marshaled, over New Relic's %d per call", len(asjson), maxSizePerCall)
+	}
+
+	if !c.reserveMemory(len(asjson)) {
+		c.countDropped(e.priority, 1)
+		return queuedEvent{}, fmt.Errorf("event dropped: MaxMemoryBytes (%d) exceeded", c.MaxMemoryBytes)
+	}
+
+	qe := queuedEvent{json: string(asjson[:]), dest: e.dest, priority: e.priority, attributes: len(values)}
+	qe.eventType, _ = e.values["eventType"].(string)
+	if c.BatchKey != nil {
+		qe.batchKey = c.BatchKey(e)
+	}
+	if len(c.CollapseRepeats) > 0 {
+		qe.repeatKey = c.repeatKey(values)
+	}
+	return qe, nil
+}
+
+// Identifies events by their c.CollapseRepeats values, or "" (never collapsing) for one lacking
+// any of them.
+func (c *Connection) repeatKey(values map[string]interface{}) string {
+	key := make([]interface{}, len(c.CollapseRepeats))
+	for i, name := range c.CollapseRepeats {
+		v, ok := values[name]
+		if !ok {
+			return ""
+		}
+		key[i] = v
+	}
+	asjson, err := json.Marshal(key)
+	if err != nil {
+		return "" // values already marshaled once, so this won't happen
+	}
+	return string(asjson)
+}
+
+// Checks the attributes New Relic requires of every event, and the timestamp's skew.
+func (c *Connection) validateEvent(e *Event) error {
+	if eventType, ok := e.values["eventType"].(string); !ok || eventType == "" {
+		return fmt.Errorf("invalid event: missing string \"eventType\"")
+	}
+
+	var ts float64
+	switch v := e.values["timestamp"].(type) {
+	case int:
+		ts = float64(v)
+	case int64:
+		ts = float64(v)
+	case float64:
+		ts = v
+	case nil:
+		return fmt.Errorf("invalid event: missing \"timestamp\"")
+	default:
+		return fmt.Errorf("invalid event: \"timestamp\" is %T, not a number", v)
+	}
+	if ts <= 0 {
+		return fmt.Errorf("invalid event: \"timestamp\" %v is not positive", ts)
+	}
+
+	if c.AllowedTimestampSkew > 0 {
+		unit := time.Second
+		if ts > 1e11 { // too far off to be seconds, so milliseconds, which New Relic accepts too
+			unit = time.Millisecond
+		}
+		at := time.Unix(0, int64(ts*float64(unit)))
+		if skew := time.Since(at); skew > c.AllowedTimestampSkew || -skew > c.AllowedTimestampSkew {
+			atomic.AddInt64(&c.counters.skewed, 1)
+			return fmt.Errorf("invalid event: \"timestamp\" %v is %v from now, past AllowedTimestampSkew (%v)", ts, skew.Round(time.Second), c.AllowedTimestampSkew)
+		}
+	}
+
+	return nil
+}
+
+// Like RegisterEvent, batching e in p's lane.
+func (c *Connection) RegisterPriority(e *Event, p Priority) error {
+	e.SetPriority(p)
+	return c.RegisterEvent(e)
+}
+
+// Like RegisterEvent, additionally setting "deadline-remaining" (floating point seconds, negative once
+// passed) when ctx has a deadline.
+func (c *Connection) RegisterEventContext(ctx context.Context, e *Event) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		e.Set("deadline-remaining", time.Until(deadline).Seconds())
+	}
+
+	return c.RegisterEvent(e)
+}
+
+// Batches everything queued and sends it, along with any batches unsent, keeping the Connection
+// running.  Returns once nothing is left to send, or with ctx's error once ctx is done, which
+// leaves the rest to the normal cycle.  Failed sends are retried per RetryBackoff meanwhile, and
+// nothing is sent while paused.  Returns ErrNotStarted before Start and ErrConnectionClosed after
+// StopAndFlush.
+func (c *Connection) Flush(ctx context.Context) error {
+	if _, err := c.flushRequest(ctx, c.flushReqs); err != nil {
+		return err
+	}
+
+	for {
+		sent, err := c.flushRequest(ctx, c.sendReqs)
+		if err != nil || sent {
+			return err
+		}
+
+		select {
+		case <-c.clock.After(flushPollDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Hands a Flush request to the goroutine reading reqs, returning its answer.  closeLock is held
+// while handing it over, so both goroutines are still running to take it.
+func (c *Connection) flushRequest(ctx context.Context, reqs chan chan bool) (bool, error) {
+	answer := make(chan bool, 1)
+
+	c.closeLock.RLock()
+	if reqs == nil {
+		c.closeLock.RUnlock()
+		return false, ErrNotStarted
+	}
+	if c.closed {
+		c.closeLock.RUnlock()
+		return false, ErrConnectionClosed
+	}
+	select {
+	case reqs <- answer:
+		c.closeLock.RUnlock()
+	case <-ctx.Done():
+		c.closeLock.RUnlock()
+		return false, ctx.Err()
+	}
+
+	select {
+	case ok := <-answer:
+		return ok, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// Immediately batches and sends only the queued events whose "eventType" is eventType, leaving
+// all others queued for the normal cycle.  Returns the number of events flushed, or
+// ErrNotStarted before Start and ErrConnectionClosed after StopAndFlush.
+func (c *Connection) FlushType(eventType string) (int, error) {
+	req := typeFlush{eventType: eventType, flushed: make(chan int, 1)}
+
+	c.closeLock.RLock()
+	if c.typeFlushes == nil {
+		c.closeLock.RUnlock()
+		return 0, ErrNotStarted
+	}
+	if c.closed {
+		c.closeLock.RUnlock()
+		return 0, ErrConnectionClosed
+	}
+	c.typeFlushes <- req // makeBatches is running while closed is false
+	c.closeLock.RUnlock()
+
+	return <-req.flushed, nil
+}
+
+// Returns a snapshot of the connection's pipeline counters, all zero before Start.
+func (c *Connection) Stats() Stats {
+	if c.counters == nil {
+		return Stats{}
+	}
+	return Stats{
+		EventsRegistered: atomic.LoadInt64(&c.counters.registered),
+		BatchesSent:      atomic.LoadInt64(&c.counters.sent),
+		SendFailures:     atomic.LoadInt64(&c.counters.failed),
+		BatchesDropped:   atomic.LoadInt64(&c.counters.queueDrops),
+		MemoryBytes:      atomic.LoadInt64(&c.counters.memoryBytes),
+		UnsentBatches:    c.unsentLen(),
+		DroppedNormal:    atomic.LoadInt64(&c.counters.dropped[NormalPriority]),
+		DroppedHigh:      atomic.LoadInt64(&c.counters.dropped[HighPriority]),
+		RejectedEvents:   atomic.LoadInt64(&c.counters.rejected),
+		SkewedEvents:     atomic.LoadInt64(&c.counters.skewed),
+		OversizedEvents:  atomic.LoadInt64(&c.counters.oversized),
+	}
+}
+
+// Accounts for n more bytes, first dropping the oldest batches if that would exceed c.MaxMemoryBytes.
+// Returns false when there's nothing left to drop and the bytes don't fit.
+func (c *Connection) reserveMemory(n int) bool {
+	if c.MaxMemoryBytes > 0 {
+		for atomic.LoadInt64(&c.counters.memoryBytes)+int64(n) > c.MaxMemoryBytes {
+			if !c.shedOldestBatch() {
+				return false
+			}
+		}
+	}
+
+	atomic.AddInt64(&c.counters.memoryBytes, int64(n))
+	return true
+}
+
+func (c *Connection) releaseMemory(n int) {
+	atomic.AddInt64(&c.counters.memoryBytes, -int64(n))
+}
+
+func (c *Connection) countDropped(p Priority, events int) {
+	atomic.AddInt64(&c.counters.dropped[p], int64(events))
+}
+
+// Releases b's memory, counts its events dropped, and tells c.OnDrop.  Never called with
+// unsentLock held, so OnDrop may call Stats.
+func (c *Connection) dropBatch(b *batch) {
+	c.releaseMemory(len(b.json))
+	c.countDropped(b.priority, b.events)
+	c.unspool(b)
+	if c.OnDrop != nil {
+		c.OnDrop(b.json, b.events)
+	}
+}
+
+// Drops the oldest NormalPriority unsent batches while waiting and unsent batches together fill
+// more than c.ExpireNormalAbove of the send queue.  Only called from sendBatches, between sends.
+func (c *Connection) expireNormal() {
+	limit := int(c.ExpireNormalAbove * float64(c.sendQueueSize()))
+
+	var expired []*batch
+	c.unsentLock.Lock()
+	elem := c.unsent.Front()
+	for elem != nil && c.unsent.Len()+len(c.batches)+len(c.highBatches) > limit {
+		next := elem.Next()
+		if b := elem.Value.(*batch); b.priority == NormalPriority {
+			c.unsent.Remove(elem)
+			expired = append(expired, b)
+		}
+		elem = next
+	}
+	c.unsentLock.Unlock()
+
+	for _, b := range expired {
+		c.log().Printf("insights: send queue over ExpireNormalAbove; dropping unsent batch of %d bytes", len(b.json))
+		c.dropBatch(b)
+	}
+}
+
+// Drops the oldest batch, preferring unsent (already tried) over those not yet picked up for
+// sending, and NormalPriority over HighPriority.
+func (c *Connection) shedOldestBatch() bool {
+	c.unsentLock.Lock()
+	elem := c.unsent.Front()
+	for elem != nil && elem.Value.(*batch).priority == HighPriority {
+		elem = elem.Next()
+	}
+	if elem == nil {
+		elem = c.unsent.Front()
+	}
+	if elem != nil {
+		b := c.unsent.Remove(elem).(*batch)
+		b.shed = true
+		c.unsentLock.Unlock()
+
+		c.dropBatch(b)
+		c.log().Printf("insights: MaxMemoryBytes exceeded; dropping unsent batch of %d bytes", len(b.json))
+		return true
+	}
+	c.unsentLock.Unlock()
+
+	for _, lane := range []chan *batch{c.batches, c.highBatches} {
+		select {
+		case b, open := <-lane:
+			if !open {
+				continue
+			}
+			c.dropBatch(b)
+			c.log().Printf("insights: MaxMemoryBytes exceeded; dropping queued batch of %d bytes", len(b.json))
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+func (c *Connection) makeBatches() {
+	ticker := c.clock.NewTicker(c.sendInterval())
+	highTicker := c.clock.NewTicker(c.highPriorityInterval())
+
+	var initial <-chan time.Time // nil, never ready, without InitialFlushDelay
+	if c.InitialFlushDelay > 0 {
+		delay := c.InitialFlushDelay
+		if c.InitialFlushJitter > 0 {
+			delay += time.Duration(mathrand.Int63n(int64(c.InitialFlushJitter)))
+		}
+		initial = c.clock.After(delay)
+	}
+
+outer:
+	for {
+		select {
+		case e, open := <-c.events:
+			if !open {
+				break outer
+			}
+
+			c.queueEvent(e)
+			if !c.queueReady(c.coalesceEvents() - 1) {
+				break outer
+			}
+
+		case e := <-c.warnEvents:
+			c.queueEvent(e)
+
+		case done := <-c.flushReqs:
+			c.drainEvents() // include anything registered before the request
+			c.makeBatch()
+			done <- true
+
+		case req := <-c.typeFlushes:
+			c.drainEvents() // include anything registered before the request
+			req.flushed <- c.makeTypeBatch(req.eventType)
+
+		case <-c.flushes:
+			c.drainEvents()
+			c.makeBatch()
+
+		case <-initial:
+			initial = nil
+			c.tick()
+
+		case <-ticker.Chan():
+			c.tick()
+
+		case <-highTicker.Chan():
+			c.makeLaneBatch(HighPriority)
+
+		case <-c.reconfig:
+			ticker.Stop()
+			highTicker.Stop()
+			ticker = c.clock.NewTicker(c.sendInterval())
+			highTicker = c.clock.NewTicker(c.highPriorityInterval())
+		}
+	}
+
+	c.queueAggregates()
+	c.drainWarnings()
+	c.makeBatch() // flush remaining
+	c.eventsDone <- true
+}
+
+// The send interval's work.
+func (c *Connection) tick() {
+	c.checkBackpressure()
+	c.queueAggregates()
+	if len(c.queues) == 0 && c.SendEmptyBatches {
+		c.queueEmptyBatch()
+	}
+	c.makeLaneBatch(NormalPriority)
+}
+
+func (c *Connection) queueEvent(e queuedEvent) {
+	key := queueKey{dest: e.dest, batchKey: e.batchKey, priority: e.priority}
+	q, ok := c.queues[key]
+	if !ok {
+		if len(c.queues) >= c.maxBatchQueues() {
+			c.makeBatch() // rather than hold ever more queues
+		}
+		q = &eventQueue{dest: e.dest, priority: e.priority}
+		c.queues[key] = q
+	}
+
+	if n := len(q.events); n > 0 && e.repeatKey != "" && q.events[n-1].repeatKey == e.repeatKey {
+		q.events[n-1].repeats++
+		c.releaseMemory(len(e.json))
+		return
+	}
+
+	q.events = append(q.events, e)
+	q.bytes += len(e.json)
+
+	// If we're within 90% (or EarlyBatchFraction) of New Relic space limits, batch early.
+	fraction := c.earlyBatchFraction()
+	if float64(len(q.events)) > maxEventsPerCall*fraction || float64(q.bytes) > maxSizePerCall*fraction {
+		if c.OnSplit != nil && c.splits[key] == nil {
+			c.splits[key] = &split{}
+		}
+		c.flushQueue(key, q)
+	}
+}
+
+func (c *Connection) maxAttributes() int {
+	if c.MaxAttributes > 0 && c.MaxAttributes < maxAttributes {
+		return c.MaxAttributes
+	}
+	return maxAttributes
+}
+
+func (c *Connection) maxValueBytes() int {
+	if c.MaxValueBytes != 0 {
+		return c.MaxValueBytes
+	}
+	return maxValueBytes
+}
+
+func (c *Connection) sendInterval() time.Duration {
+	if interval := c.config().SendInterval; interval > 0 {
+		return interval
+	}
+	return sendInterval
+}
+
+func (c *Connection) sendQueueSize() int {
+	if c.SendQueueSize > 0 {
+		return c.SendQueueSize
+	}
+	return sendQueueSize
+}
+
+func (c *Connection) earlyBatchFraction() float64 {
+	if c.EarlyBatchFraction > 0 && c.EarlyBatchFraction < 1 {
+		return c.EarlyBatchFraction
+	}
+	return earlyBatchFraction
+}
+
+func (c *Connection) highPriorityInterval() time.Duration {
+	if interval := c.config().HighPriorityInterval; interval > 0 {
+		return interval
+	}
+	return highPriorityInterval
+}
+
+func (c *Connection) maxBatchQueues() int {
+	if c.MaxBatchQueues > 0 {
+		return c.MaxBatchQueues
+	}
+	return defaultMaxBatchQueues
+}
+
+func (c *Connection) coalesceEvents() int {
+	if c.CoalesceEvents > 0 {
+		return c.CoalesceEvents
+	}
+	return defaultCoalesceEvents
+}
+
+// A wake-up's worth of events, so a burst waits in the buffer for one coalesced read rather than
+// blocking its registrations; at least 10, to amortize the cost of batching under high load.
+func (c *Connection) eventsBuffer() int {
+	if n := c.coalesceEvents(); n > 10 {
+		return n
+	}
+	return 10
+}
+
+// Queues whatever is already waiting on c.events, without blocking.
+func (c *Connection) drainEvents() {
+	c.queueReady(-1)
+}
+
+// Queues up to max (negative for no limit) of the events already waiting on c.events, without
+// blocking.  Returns false once c.events is closed.
+func (c *Connection) queueReady(max int) bool {
+	for ; max != 0; max-- {
+		select {
+		case e, open := <-c.events:
+			if !open {
+				return false
+			}
+			c.queueEvent(e)
+		default:
+			return true
+		}
+	}
+	return true
+}
+
+// Queues whatever limit warnings are waiting, without blocking.
+func (c *Connection) drainWarnings() {
+	for {
+		select {
+		case e := <-c.warnEvents:
+			c.queueEvent(e)
+		default:
+			return
+		}
+	}
+}
+
+// Batches every queue.
+func (c *Connection) makeBatch() {
+	for key, q := range c.queues {
+		c.flushQueue(key, q)
+	}
+	c.reportSplits(func(queueKey) bool { return true })
+}
+
+// Batches every queue in one priority lane.
+func (c *Connection) makeLaneBatch(p Priority) {
+	for key, q := range c.queues {
+		if q.priority == p {
+			c.flushQueue(key, q)
+		}
+	}
+	c.reportSplits(func(key queueKey) bool { return key.priority == p })
+}
+
+// Batches q, removing it from c.queues.
+func (c *Connection) flushQueue(key queueKey, q *eventQueue) {
+	if s := c.splits[key]; s != nil {
+		s.events += len(q.events)
+		s.batches++
+	}
+	c.queueBatch(q, q.events)
+	delete(c.queues, key)
+}
+
+// Tells OnSplit about the queues matching lane that were batched early since their last flush, as
+// well as just now.
+func (c *Connection) reportSplits(lane func(queueKey) bool) {
+	for key, s := range c.splits {
+		if !lane(key) {
+			continue
+		}
+		if s.batches > 1 {
+			c.OnSplit(s.events, s.batches)
+		}
+		delete(c.splits, key)
+	}
+}
+
+// Pulls the events of one type out of every queue and batches them on their own.
+func (c *Connection) makeTypeBatch(eventType string) int {
+	flushed := 0
+	for key, q := range c.queues {
+		var matched, rest []queuedEvent
+		for _, e := range q.events {
+			if e.eventType == eventType {
+				matched = append(matched, e)
+				q.bytes -= len(e.json)
+			} else {
+				rest = append(rest, e)
+			}
+		}
+
+		if len(matched) > 0 {
+			c.queueBatch(q, matched)
+			flushed += len(matched)
+		}
+		if len(rest) == 0 {
+			delete(c.queues, key)
+		} else {
+			q.events = rest
+		}
+	}
+
+	return flushed
+}
+
+// Batches events from q into q's lane.
+func (c *Connection) queueBatch(q *eventQueue, events []queuedEvent) {
+	// New Relic rejects a whole batch over one event past the attribute cap,
+	// so those events are dropped here rather than sent with the rest.  The
+	// count is checked at registration, so only attributes added since (by
+	// FlushEnricher, which recounts, or repeat-count) can take one past it.
+	limit := c.maxAttributes()
+	jsons := make([]string, 0, len(events))
+	eventBytes := 0
+	for _, e := range events {
+		if e.repeats > 0 {
+			c.setRepeatCount(&e)
+		}
+		if c.FlushEnricher != nil {
+			c.enrich(&e)
+		}
+		if e.attributes > limit {
+			c.log().Printf("insights queueBatch: dropping %q event with %d attributes (max %d)", e.eventType, e.attributes, limit)
+			c.releaseMemory(len(e.json))
+			c.countDropped(e.priority, e.repeats+1)
+			continue
+		}
+		jsons = append(jsons, e.json)
+		eventBytes += len(e.json)
+	}
+	if len(jsons) == 0 {
+		return
+	}
+	b := &batch{json: "[" + strings.Join(jsons, ",") + "]", dest: q.dest, priority: q.priority, events: len(jsons)}
+	atomic.AddInt64(&c.counters.memoryBytes, int64(len(b.json)-eventBytes)) // brackets and commas
+
+	lane := c.batches
+	if b.priority == HighPriority {
+		lane = c.highBatches
+	}
+
+	select {
+	case lane <- b:
+	default:
+		c.log().Printf("insights queueBatch: send queue full; dropping batch of %d events", b.events)
+		atomic.AddInt64(&c.counters.queueDrops, 1)
+		c.dropBatch(b)
+	}
+
+	c.checkBackpressure()
+}
+
+// Adds "repeat-count" to e's marshaled json, counting e and the events collapsed into it.
+func (c *Connection) setRepeatCount(e *queuedEvent) {
+	field := fmt.Sprintf(`"repeat-count":%d`, e.repeats+1)
+	if e.json != "{}" {
+		field += ","
+	}
+	atomic.AddInt64(&c.counters.memoryBytes, int64(len(field)))
+	e.json = "{" + field + e.json[1:]
+	e.attributes++
+}
+
+// Runs c.FlushEnricher on e, re-marshaling it.  Events that fail to round-trip are left as they
+// were.
+func (c *Connection) enrich(e *queuedEvent) {
+	var values map[string]interface{}
+	d := json.NewDecoder(strings.NewReader(e.json))
+	d.UseNumber()
+	if err := d.Decode(&values); err != nil {
+		c.log().Printf("insights enrich: could not decode event: %v", err)
+		return
+	}
+
+	c.FlushEnricher(values)
+
+	asjson, err := json.Marshal(values)
+	if err != nil {
+		c.log().Printf("insights enrich: could not marshal event: %v", err)
+		return
+	}
+	atomic.AddInt64(&c.counters.memoryBytes, int64(len(asjson)-len(e.json)))
+	e.json = string(asjson)
+	e.attributes = len(values)
+}
+
+// Tells OnBackpressure when the batch queue crosses its high or low watermark.
+func (c *Connection) checkBackpressure() {
+	if c.OnBackpressure == nil {
+		return
+	}
+
+	queued, capacity := len(c.batches), cap(c.batches)
+	switch {
+	case !c.overloaded && float64(queued) >= backpressureHigh*float64(capacity):
+		c.overloaded = true
+	case c.overloaded && float64(queued) <= backpressureLow*float64(capacity):
+		c.overloaded = false
+	default:
+		return
+	}
+
+	c.OnBackpressure(queued, capacity)
+}
+
+func (c *Connection) queueEmptyBatch() {
+	b := &batch{json: "[]"}
+	if !c.reserveMemory(len(b.json)) {
+		return
+	}
+
+	select {
+	case c.batches <- b:
+	default:
+		c.releaseMemory(len(b.json))
+	}
+}
+
+func (c *Connection) sendBatches() {
+	var pace <-chan time.Time // nil, never ready, without MaxBatchesPerTick
+	var paceTicker ticker
+	if c.MaxBatchesPerTick > 0 {
+		paceTicker = c.clock.NewTicker(c.sendInterval())
+		defer func() { paceTicker.Stop() }()
+		pace = paceTicker.Chan()
+		c.pacing = true
+	}
+
+	var retry <-chan time.Time // nil while no batch is backing off
+
+	batches, highBatches := c.batches, c.highBatches
+	for batches != nil || highBatches != nil {
+		select {
+		case b, open := <-highBatches:
+			if !open {
+				highBatches = nil // stop selecting it
+				continue
+			}
+			c.pushUnsent(b)
+			if c.ExpireNormalAbove > 0 {
+				c.expireNormal()
+			}
+			c.sendUnsent()
+
+		case b, open := <-batches:
+			if !open {
+				batches = nil
+				continue
+			}
+			c.pushUnsent(b)
+			if c.ExpireNormalAbove > 0 {
+				c.expireNormal()
+			}
+			c.sendUnsent()
+
+		case <-c.resumed:
+			c.sendUnsent()
+
+		case sent := <-c.sendReqs:
+			c.pushReady()
+			c.sendUnsent()
+			sent <- c.unsentLen() == 0
+
+		case <-pace:
+			c.tickSends = 0
+			c.sendUnsent()
+
+		case <-c.repace:
+			if paceTicker != nil { // the interval's sends so far still count
+				paceTicker.Stop()
+				paceTicker = c.clock.NewTicker(c.sendInterval())
+				pace = paceTicker.Chan()
+			}
+
+		case <-retry:
+			c.sendUnsent()
+		}
+
+		retry = c.nextRetry()
+	}
+
+	atomic.StoreInt32(&c.paused, 0) // the final flush goes out regardless
+	c.pacing = false
+	c.final = true
 	c.httpTimeout = fastHttpTimeout // decrease for prompt exit
-	c.sendUnsent()
+	c.finalFlush()
 
 	c.batchesDone <- true
 }
 
+// Sends everything left, retrying per c.ShutdownRetries within c.ShutdownTimeout and c.stopCtx.
+func (c *Connection) finalFlush() {
+	if c.ShutdownTimeout > 0 {
+		c.deadline = time.Now().Add(c.ShutdownTimeout)
+	}
+	if deadline, ok := c.stopCtx.Deadline(); ok && (c.deadline.IsZero() || deadline.Before(c.deadline)) {
+		c.deadline = deadline
+	}
+
+	for attempt := 0; c.stopCtx.Err() == nil; attempt++ {
+		c.sendUnsent()
+
+		if c.unsentLen() == 0 || attempt >= c.ShutdownRetries || c.pastDeadline(shutdownRetryDelay) {
+			break
+		}
+		select {
+		case <-c.clock.After(shutdownRetryDelay):
+		case <-c.stopCtx.Done():
+		}
+	}
+
+	if n := c.unsentLen(); n > 0 {
+		c.log().Printf("insights: %d batches undelivered at shutdown", n)
+		if c.SpoolDir != "" {
+			c.spoolUnsent()
+		}
+	}
+}
+
+// Whether c.deadline is set and less than d away.
+func (c *Connection) pastDeadline(d time.Duration) bool {
+	return !c.deadline.IsZero() && time.Until(c.deadline) < d
+}
+
+// A context for one send, timing out per sendTimeout, and in the final flush, ending with c.stopCtx.
+func (c *Connection) sendContext() (context.Context, context.CancelFunc) {
+	parent := context.Background()
+	if c.final {
+		parent = c.stopCtx
+	}
+	return context.WithTimeout(parent, c.sendTimeout())
+}
+
+// The HTTP timeout, shortened to fit within c.deadline.
+func (c *Connection) sendTimeout() time.Duration {
+	if c.deadline.IsZero() {
+		return c.httpTimeout
+	}
+	if left := time.Until(c.deadline); left < c.httpTimeout {
+		return left
+	}
+	return c.httpTimeout
+}
+
+func (c *Connection) unsentLen() int {
+	c.unsentLock.Lock()
+	defer c.unsentLock.Unlock()
+	return c.unsent.Len()
+}
+
+// Moves whatever batches are already waiting in the lanes to unsent, without blocking, for Flush.
+func (c *Connection) pushReady() {
+	for {
+		select {
+		case b, open := <-c.highBatches:
+			if !open {
+				return
+			}
+			c.pushUnsent(b)
+		case b, open := <-c.batches:
+			if !open {
+				return
+			}
+			c.pushUnsent(b)
+		default:
+			if c.ExpireNormalAbove > 0 {
+				c.expireNormal()
+			}
+			return
+		}
+	}
+}
+
+// Appends b to unsent, or for HighPriority, after only the HighPriority batches already there.
+func (c *Connection) pushUnsent(b *batch) {
+	if c.coolingDown() {
+		if n := c.unsentLen(); n >= c.sendQueueSize() {
+			c.log().Printf("insights: rate limited with %d batches unsent; dropping batch of %d bytes", n, len(b.json))
+			c.dropBatch(b)
+			return
+		}
+	}
+
+	c.unsentLock.Lock()
+	defer c.unsentLock.Unlock()
+
+	if b.priority != HighPriority {
+		c.unsent.PushBack(b)
+		return
+	}
+
+	elem := c.unsent.Front()
+	for elem != nil && elem.Value.(*batch).priority == HighPriority {
+		elem = elem.Next()
+	}
+	if elem == nil {
+		c.unsent.PushBack(b)
+	} else {
+		c.unsent.InsertBefore(b, elem)
+	}
+}
+
 func (c *Connection) sendUnsent() {
-	var next *list.Element
-	for elem := c.unsent.Front(); elem != nil; elem = next {
-		next = elem.Next()
+	c.unsentLock.Lock()
+	elem := c.unsent.Front()
+	c.unsentLock.Unlock()
+
+	// The lock isn't held while sending, so a batch may be shed out from under us; a shed element
+	// has no Next, which just ends this pass early.
+	for elem != nil && !c.isPaused() && !c.pastDeadline(0) && !c.coolingDown() {
+		b := elem.Value.(*batch)
+		if !c.final && c.now().Before(b.retryAt) {
+			c.unsentLock.Lock()
+			elem = elem.Next()
+			c.unsentLock.Unlock()
+			continue
+		}
 
-		if c.sendBatch(elem.Value.(string)) {
-			c.unsent.Remove(elem)
+		if c.pacing {
+			if c.tickSends >= c.MaxBatchesPerTick {
+				return
+			}
+			c.tickSends++
+		}
+
+		sent := c.deliver(b)
+		if sent {
+			atomic.AddInt64(&c.counters.sent, 1)
+		} else {
+			atomic.AddInt64(&c.counters.failed, 1)
+		}
+
+		c.unsentLock.Lock()
+		next := elem.Next()
+		if !sent {
+			b.failures++
+			b.retryAt = c.now().Add(c.retryBackoff(b.failures))
+		}
+		var done, exhausted bool // a shed batch is neither, as it's already been dropped
+		if !b.shed {
+			done = sent
+			exhausted = !sent && c.MaxRetries > 0 && b.failures > c.MaxRetries
+			if done || exhausted {
+				c.unsent.Remove(elem)
+			}
+		}
+		c.unsentLock.Unlock()
+
+		if done {
+			c.releaseMemory(len(b.json))
+			c.unspool(b)
+		} else if exhausted {
+			c.log().Printf("insights: dropping batch of %d bytes after %d failed sends", len(b.json), b.failures)
+			c.dropBatch(b)
+		}
+
+		elem = next
+	}
+}
+
+// The delay after a batch's nth failed send: RetryBackoff, doubled per failure since the first,
+// up to the send interval.
+func (c *Connection) retryBackoff(n int) time.Duration {
+	backoff := c.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	interval := c.sendInterval()
+	for i := 1; i < n && backoff < interval; i++ {
+		backoff *= 2
+	}
+	if backoff > interval {
+		backoff = interval
+	}
+	return backoff
+}
+
+// Fires when the soonest backing-off unsent batch is due for resending, or never (nil) if none are.
+// Unsent batches wait out a cool-down too.
+func (c *Connection) nextRetry() <-chan time.Time {
+	var soonest time.Time
+	c.unsentLock.Lock()
+	for elem := c.unsent.Front(); elem != nil; elem = elem.Next() {
+		if at := elem.Value.(*batch).retryAt; !at.IsZero() && (soonest.IsZero() || at.Before(soonest)) {
+			soonest = at
+		}
+	}
+	if c.coolingDown() && c.unsent.Len() > 0 && c.coolUntil.After(soonest) {
+		soonest = c.coolUntil
+	}
+	c.unsentLock.Unlock()
+
+	if soonest.IsZero() {
+		return nil
+	}
+	return c.clock.After(soonest.Sub(c.now()))
+}
+
+// Whether a 429 asked that nothing more be sent yet.  The final flush goes out regardless.
+func (c *Connection) coolingDown() bool {
+	return !c.final && c.now().Before(c.coolUntil)
+}
+
+// Parses a Retry-After header, in seconds or as an HTTP date; ok is false if there's none.
+func retryAfter(header string, now time.Time) (d time.Duration, ok bool) {
+	if header == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second, secs >= 0
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return at.Sub(now), true
+	}
+	return 0, false
+}
+
+// Hands b to c.Sender if there is one, otherwise sends it to Insights.
+// Reports the attempt to c.OnSend.
+func (c *Connection) deliver(b *batch) bool {
+	result := SendResult{Destination: b.dest, Bytes: len(b.json)}
+	start := time.Now()
+
+	if c.Sender == nil {
+		result.Sent = c.sendBatch(b, &result)
+	} else {
+		ctx, cancel := c.sendContext()
+		result.Err = c.Sender.Send(ctx, []byte(b.json), b.dest)
+		cancel()
+
+		if result.Err != nil {
+			c.log().Printf("insights deliver: %v; queueing for resend", result.Err)
+		} else {
+			result.Sent = true
 		}
 	}
+
+	if c.OnSend != nil {
+		result.Duration = time.Since(start)
+		c.OnSend(result)
+	}
+
+	return result.Sent
 }
 
-func (c *Connection) sendBatch(batch string) bool {
-	url := fmt.Sprintf("https://insights-collector.newrelic.com/v1/accounts/%d/events", c.NewRelicAccountId)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte(batch)))
+// Sends b to Insights, filling in result along the way.
+func (c *Connection) sendBatch(b *batch, result *SendResult) bool {
+	accountId, apiKey := c.NewRelicAccountId, c.insertKey.Load().(string)
+	if b.dest.AccountId != 0 {
+		accountId = b.dest.AccountId
+	}
+	if b.dest.InsightsAPIKey != "" {
+		apiKey = b.dest.InsightsAPIKey
+	}
+
+	body := []byte(b.json)
+	if c.Compress {
+		if b.gz == nil {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write(body) // writes to a bytes.Buffer don't fail
+			zw.Close()
+			b.gz = buf.Bytes()
+		}
+		body = b.gz
+	}
+
+	// Per request rather than per client, as the timeout shortens for the final flush.
+	ctx, cancel := c.sendContext()
+	defer cancel()
+
+	url := c.eventsURL(accountId)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
-		log.Printf("insights sendBatch: failed to create http request: %v; queueing for resend", err)
+		result.Err = err
+		c.log().Printf("insights sendBatch: failed to create http request: %v; queueing for resend", err)
 		return false
 	}
-	req.Header.Set("X-Insert-Key", c.InsightsAPIKey)
+	if c.TraceSends {
+		result.Trace = &SendTrace{}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), result.Trace.clientTrace()))
+	}
+	req.Header.Set("X-Insert-Key", apiKey)
 	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{
-		Timeout: c.httpTimeout,
+	if c.Compress {
+		req.Header.Set("Content-Encoding", "gzip")
 	}
-	resp, err := client.Do(req)
+	req.Header.Set("User-Agent", c.UserAgent)
+
+	resp, err := c.client.Do(req)
 	if err != nil {
-		log.Printf("insights sendBatch: failed to send http request: %v; queueing for resend", err)
+		result.Err = err
+		c.log().Printf("insights sendBatch: failed to send http request: %v; queueing for resend", err)
 		return false
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
+	result.StatusCode = resp.StatusCode
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if d, ok := retryAfter(resp.Header.Get("Retry-After"), c.now()); ok {
+			c.coolUntil = c.now().Add(d)
+			c.log().Printf("insights sendBatch: rate limited; queueing for resend, sending nothing for %v", d)
+		} else {
+			c.log().Printf("insights sendBatch: rate limited; queueing for resend")
+		}
+		return false
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			log.Printf("insights sendBatch: failed to read response body: %v; queueing for resend")
+			result.Err = err
+			c.log().Printf("insights sendBatch: failed to read response body: %v; queueing for resend", err)
 			return false
 		}
 
-		log.Printf("insights sendBatch: non-200 result: %d [%s]; queueing for resend", resp.StatusCode, body)
+		result.Err = fmt.Errorf("collector responded %d", resp.StatusCode)
+		c.log().Printf("insights sendBatch: non-2xx result: %d [%s]; queueing for resend", resp.StatusCode, body)
+		return false
+	}
+	if c.RejectedEventsPath != "" {
+		c.checkRejected(b, resp.Body)
 	}
 
 	return true
 }
+
+func (c *Connection) eventsURL(accountId int) string {
+	base := c.Endpoint
+	if base == "" {
+		host, ok := collectorHosts[c.Region]
+		if !ok {
+			host = collectorHosts[RegionUS]
+		}
+		base = "https://" + host
+	}
+	return fmt.Sprintf("%s/v1/accounts/%d/events", strings.TrimSuffix(base, "/"), accountId)
+}
+
+// Counts the events a collector's response reports rejecting, per c.RejectedEventsPath.
+func (c *Connection) checkRejected(b *batch, body io.Reader) {
+	var response interface{}
+	if err := json.NewDecoder(body).Decode(&response); err != nil {
+		return // not JSON, so no partial success to report
+	}
+
+	v, ok := jsonPath(response, c.RejectedEventsPath)
+	var rejected float64
+	switch n := v.(type) {
+	case float64:
+		rejected = n
+	case string: // as protobuf's JSON mapping writes int64s
+		rejected, _ = strconv.ParseFloat(n, 64)
+	}
+	if !ok || rejected <= 0 {
+		return
+	}
+
+	c.log().Printf("insights sendBatch: collector rejected %d of %d events", int(rejected), b.events)
+	atomic.AddInt64(&c.counters.rejected, int64(rejected))
+	if c.OnRejected != nil {
+		c.OnRejected([]byte(b.json), int(rejected))
+	}
+}
+
+// Looks up a dot-separated path of object keys in decoded JSON.
+func jsonPath(v interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
@@ -0,0 +1,347 @@
+package nrinsights
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A Sender keeping every batch, failing each with err if set.
+type recordingSender struct {
+	mu      sync.Mutex
+	batches []string
+	err     error
+}
+
+func (s *recordingSender) Send(ctx context.Context, batch []byte, dest Destination) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, string(batch))
+	return s.err
+}
+
+func (s *recordingSender) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.batches...)
+}
+
+// Logs to the test's log, shown only for failures (or -v).
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Printf(format string, args ...interface{}) {
+	l.t.Logf(format, args...)
+}
+
+// Starts c, delivering to a recordingSender unless c has a Sender or credentials, and stops it
+// when the test ends.
+func startTest(t *testing.T, c *Connection) *Connection {
+	t.Helper()
+	if c.Sender == nil && c.InsightsAPIKey == "" {
+		c.Sender = &recordingSender{}
+	}
+	if c.Logger == nil {
+		c.Logger = testLogger{t}
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() {
+		c.closeLock.RLock()
+		closed := c.closed
+		c.closeLock.RUnlock()
+		if !closed {
+			c.StopAndFlush()
+		}
+	})
+	return c
+}
+
+// The next event on ch, unmarshaled.
+func nextEvent(t *testing.T, ch <-chan []byte) map[string]interface{} {
+	t.Helper()
+	select {
+	case event := <-ch:
+		var values map[string]interface{}
+		if err := json.Unmarshal(event, &values); err != nil {
+			t.Fatalf("unmarshal %s: %v", event, err)
+		}
+		return values
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event registered")
+		return nil
+	}
+}
+
+// Serves r with h under c.Middleware, returning the event registered.
+func serve(t *testing.T, c *Connection, h http.HandlerFunc, r *http.Request) map[string]interface{} {
+	t.Helper()
+	ch := c.Subscribe()
+	c.Middleware(h, nil).ServeHTTP(httptest.NewRecorder(), r)
+	return nextEvent(t, ch)
+}
+
+func TestMiddlewareRecordsFirstStatus(t *testing.T) {
+	c := startTest(t, &Connection{})
+	event := serve(t, c, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.WriteHeader(http.StatusInternalServerError) // ignored by net/http, and by the event
+	}, httptest.NewRequest("GET", "/a", nil))
+
+	if event["status-code"] != float64(http.StatusCreated) {
+		t.Errorf("status-code = %v, want %d", event["status-code"], http.StatusCreated)
+	}
+}
+
+func TestFlushTypeOutsideRun(t *testing.T) {
+	c := &Connection{Sender: &recordingSender{}}
+	if _, err := c.FlushType("Transaction"); err != ErrNotStarted {
+		t.Errorf("before Start: err = %v, want ErrNotStarted", err)
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c.RegisterEvent(c.NewEvent())
+	if n, err := c.FlushType("Transaction"); err != nil || n != 1 {
+		t.Errorf("FlushType = %d, %v; want 1, nil", n, err)
+	}
+
+	c.StopAndFlush()
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.FlushType("Transaction")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrConnectionClosed {
+			t.Errorf("after StopAndFlush: err = %v, want ErrConnectionClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("FlushType blocked after StopAndFlush")
+	}
+}
+
+func TestCollapseRepeatsLeavesRoomForCount(t *testing.T) {
+	sender := &recordingSender{}
+	c := startTest(t, &Connection{Sender: sender, CollapseRepeats: []string{"eventType"}})
+	event := func(attributes int) *Event {
+		e := c.NewEvent()
+		for i := len(e.values); i < attributes; i++ {
+			e.Set(fmt.Sprintf("attr%03d", i), i)
+		}
+		return e
+	}
+
+	if err := c.RegisterEvent(event(maxAttributes)); err == nil {
+		t.Error("registered an event at MaxAttributes, leaving no room for repeat-count")
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.RegisterEvent(event(maxAttributes - 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	var events []map[string]interface{}
+	for _, b := range sender.sent() {
+		var batch []map[string]interface{}
+		if err := json.Unmarshal([]byte(b), &batch); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, batch...)
+	}
+	if len(events) != 1 || events[0]["repeat-count"] != float64(3) || len(events[0]) != maxAttributes {
+		t.Fatalf("sent %d events, want one of %d attributes with repeat-count 3", len(events), maxAttributes)
+	}
+}
+
+func TestQueueBatchCountsDroppedRun(t *testing.T) {
+	c := &Connection{counters: &counters{}}
+	c.queueBatch(&eventQueue{}, []queuedEvent{{json: "{}", attributes: maxAttributes + 1, repeats: 2}})
+	if n := c.counters.dropped[NormalPriority]; n != 3 {
+		t.Errorf("dropped %d events, want all 3 of the run", n)
+	}
+}
+
+// A Sender closing ticked when it gets a batch holding want.
+type watchingSender struct {
+	want   string
+	once   sync.Once
+	ticked chan bool
+}
+
+func (s *watchingSender) Send(ctx context.Context, batch []byte, dest Destination) error {
+	if strings.Contains(string(batch), s.want) {
+		s.once.Do(func() { close(s.ticked) })
+	}
+	return nil
+}
+
+func TestTickerHonoredUnderFlood(t *testing.T) {
+	// A lone event in its own queue only goes out on a tick; the flood's queue goes out early.
+	sender := &watchingSender{want: `"lane":"quiet"`, ticked: make(chan bool)}
+	c := startTest(t, &Connection{
+		Sender:       sender,
+		SendInterval: 20 * time.Millisecond,
+		BatchKey:     func(e *Event) string { lane, _ := e.values["lane"].(string); return lane },
+	})
+
+	stop := make(chan bool)
+	flooded := make(chan bool)
+	go func() {
+		defer close(flooded)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			e := c.NewEvent()
+			e.Set("lane", "flood")
+			c.RegisterEvent(e)
+		}
+	}()
+	defer func() { close(stop); <-flooded }()
+
+	e := c.NewEvent()
+	e.Set("lane", "quiet")
+	if err := c.RegisterEvent(e); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sender.ticked:
+	case <-time.After(time.Second):
+		t.Fatal("no tick within 50 send intervals while flooded")
+	}
+}
+
+func TestMutatorPanicKeepsEvent(t *testing.T) {
+	c := startTest(t, &Connection{})
+	ch := c.Subscribe()
+	served := false
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = true
+	}), func(r *http.Request, e *Event) {
+		e.Set("before-panic", true)
+		panic("buggy mutator")
+	})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/a", nil))
+
+	if !served {
+		t.Error("request not served after the mutator panicked")
+	}
+	event := nextEvent(t, ch)
+	if event["mutator-panicked"] != true || event["before-panic"] != true {
+		t.Errorf("mutator-panicked = %v, before-panic = %v; want both true", event["mutator-panicked"], event["before-panic"])
+	}
+}
+
+func TestCollapseRepeatsNeedsKeyAttributes(t *testing.T) {
+	sender := &recordingSender{}
+	c := startTest(t, &Connection{Sender: sender, CollapseRepeats: []string{"eventType", "message"}})
+	for _, url := range []string{"/a", "/b", "/c"} {
+		e := c.NewEvent() // a Transaction, without "message"
+		e.Set("url", url)
+		if err := c.RegisterEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	var batch []map[string]interface{}
+	if sent := sender.sent(); len(sent) != 1 || json.Unmarshal([]byte(sent[0]), &batch) != nil {
+		t.Fatalf("sent %q, want one batch", sent)
+	}
+	if len(batch) != 3 {
+		t.Fatalf("sent %d events, want all 3 uncollapsed", len(batch))
+	}
+	for _, event := range batch {
+		if count, ok := event["repeat-count"]; ok {
+			t.Errorf("%v: repeat-count %v, want none", event["url"], count)
+		}
+	}
+}
+
+func TestBeforeStart(t *testing.T) {
+	c := &Connection{}
+	if stats := c.Stats(); stats != (Stats{}) {
+		t.Errorf("Stats = %+v, want zeros", stats)
+	}
+	if err := c.RegisterEvent(c.NewEvent()); err != ErrNotStarted {
+		t.Errorf("RegisterEvent = %v, want ErrNotStarted", err)
+	}
+	if err := c.RegisterTyped(benchTransaction{EventType: "Transaction"}); err != ErrNotStarted {
+		t.Errorf("RegisterTyped = %v, want ErrNotStarted", err)
+	}
+}
+
+func TestSubscribersSeeOnlyQueuedEvents(t *testing.T) {
+	c := startTest(t, &Connection{})
+	ch := c.Subscribe()
+
+	// As during StopAndFlush, before subscribers are closed.
+	c.closeLock.Lock()
+	c.closed = true
+	c.closeLock.Unlock()
+	if err := c.RegisterEvent(c.NewEvent()); err != ErrConnectionClosed {
+		t.Errorf("RegisterEvent = %v, want ErrConnectionClosed", err)
+	}
+	if err := c.RegisterTyped(benchTransaction{EventType: "Transaction"}); err != ErrConnectionClosed {
+		t.Errorf("RegisterTyped = %v, want ErrConnectionClosed", err)
+	}
+	select {
+	case event := <-ch:
+		t.Errorf("subscriber got rejected event %s", event)
+	default:
+	}
+
+	c.closeLock.Lock()
+	c.closed = false
+	c.closeLock.Unlock()
+	if err := c.RegisterEvent(c.NewEvent()); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, ch)
+}
+
+func TestEnrichedPastMaxAttributes(t *testing.T) {
+	sender := &recordingSender{}
+	extra := 0
+	c := startTest(t, &Connection{Sender: sender, MaxAttributes: 20, FlushEnricher: func(e map[string]interface{}) {
+		for i := 0; i < extra; i++ {
+			e[fmt.Sprintf("load%02d", i)] = i
+		}
+	}})
+	base := len(c.NewEvent().values)
+
+	for _, extra = range []int{20 - base, 21 - base} {
+		c.RegisterEvent(c.NewEvent())
+		if _, err := c.FlushType("Transaction"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := c.Stats().DroppedNormal; n != 1 {
+		t.Errorf("dropped %d events, want only the one enriched past MaxAttributes", n)
+	}
+	if sent := awaitBatches(t, sender, 1); strings.Count(sent[0], `"load`) != 20-base {
+		t.Errorf("sent %s, want the event enriched up to MaxAttributes", sent[0])
+	}
+}
@@ -0,0 +1,190 @@
+// Package otlp exports nrinsights events to an OpenTelemetry collector as OTLP log records, over
+// OTLP/HTTP with JSON encoding.
+//
+//	insights = &nrinsights.Connection{
+//	    Sender: &otlp.Sender{Endpoint: "http://localhost:4318/v1/logs"},
+//	}
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/mandagill/nrinsights"
+)
+
+// Sends batches to an OTLP/HTTP logs endpoint.  Each event becomes one log record whose body is
+// the event's "eventType" and whose attributes are all of the event's attributes.
+type Sender struct {
+	// Full URL of the collector's logs endpoint, e.g. "http://localhost:4318/v1/logs"
+	Endpoint string
+
+	// Extra request headers, e.g. for authentication
+	Headers map[string]string
+
+	// Reported as the resource's "service.name", when set
+	ServiceName string
+
+	// Defaults to http.DefaultClient
+	Client *http.Client
+}
+
+// The subset of the OTLP JSON encoding (opentelemetry-proto, logs/v1) that's needed.
+type exportRequest struct {
+	ResourceLogs []resourceLogs `json:"resourceLogs"`
+}
+
+type resourceLogs struct {
+	Resource  resource    `json:"resource"`
+	ScopeLogs []scopeLogs `json:"scopeLogs"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes,omitempty"`
+}
+
+type scopeLogs struct {
+	Scope      scope       `json:"scope"`
+	LogRecords []logRecord `json:"logRecords"`
+}
+
+type scope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type logRecord struct {
+	TimeUnixNano string     `json:"timeUnixNano,omitempty"`
+	Body         anyValue   `json:"body"`
+	Attributes   []keyValue `json:"attributes"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64s are strings in OTLP JSON
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// Implements nrinsights.Sender.  dest is ignored: the collector decides where records go.
+func (s *Sender) Send(ctx context.Context, batch []byte, dest nrinsights.Destination) error {
+	body, err := s.encode(batch)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create otlp request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send otlp request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("otlp collector returned %d [%s]", resp.StatusCode, msg)
+	}
+
+	return nil
+}
+
+// Converts a JSON array of events into an OTLP logs export request.
+func (s *Sender) encode(batch []byte) ([]byte, error) {
+	var events []map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(batch))
+	dec.UseNumber()
+	if err := dec.Decode(&events); err != nil {
+		return nil, fmt.Errorf("failed to decode batch: %v", err)
+	}
+
+	records := make([]logRecord, 0, len(events))
+	for _, event := range events {
+		records = append(records, toLogRecord(event))
+	}
+
+	rl := resourceLogs{
+		ScopeLogs: []scopeLogs{{
+			Scope:      scope{Name: "nrinsights", Version: nrinsights.Version},
+			LogRecords: records,
+		}},
+	}
+	if s.ServiceName != "" {
+		rl.Resource.Attributes = []keyValue{{Key: "service.name", Value: toAnyValue(s.ServiceName)}}
+	}
+
+	return json.Marshal(exportRequest{ResourceLogs: []resourceLogs{rl}})
+}
+
+func toLogRecord(event map[string]interface{}) logRecord {
+	keys := make([]string, 0, len(event))
+	for k := range event {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var rec logRecord
+	for _, k := range keys {
+		rec.Attributes = append(rec.Attributes, keyValue{Key: k, Value: toAnyValue(event[k])})
+	}
+
+	eventType, _ := event["eventType"].(string)
+	rec.Body = toAnyValue(eventType)
+
+	if n, ok := event["timestamp"].(json.Number); ok {
+		if ts, err := n.Int64(); err == nil {
+			// Insights timestamps are seconds or milliseconds, told apart by magnitude.
+			if ts < 1e11 {
+				ts *= 1000
+			}
+			rec.TimeUnixNano = strconv.FormatInt(ts*1e6, 10)
+		}
+	}
+
+	return rec
+}
+
+func toAnyValue(v interface{}) anyValue {
+	switch v := v.(type) {
+	case string:
+		return anyValue{StringValue: &v}
+	case bool:
+		return anyValue{BoolValue: &v}
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			s := v.String()
+			return anyValue{IntValue: &s}
+		}
+		if f, err := v.Float64(); err == nil {
+			return anyValue{DoubleValue: &f}
+		}
+		s := v.String()
+		return anyValue{StringValue: &s}
+	default:
+		s := fmt.Sprint(v)
+		return anyValue{StringValue: &s}
+	}
+}
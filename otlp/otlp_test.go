@@ -0,0 +1,139 @@
+package otlp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mandagill/nrinsights"
+)
+
+// A collector keeping the last export request, answering with status.
+func newCollector(t *testing.T, status int, got *exportRequest, header *http.Header) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*header = r.Header
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, got); err != nil {
+			t.Errorf("unmarshal %s: %v", body, err)
+		}
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			w.Write([]byte("collector unhappy"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func str(s string) anyValue { return anyValue{StringValue: &s} }
+
+func TestSendEncodesLogRecords(t *testing.T) {
+	var got exportRequest
+	var header http.Header
+	srv := newCollector(t, http.StatusOK, &got, &header)
+	s := &Sender{Endpoint: srv.URL, Headers: map[string]string{"Api-Key": "secret"}, ServiceName: "checkout"}
+
+	batch := `[{"eventType":"Transaction","timestamp":1600000000,"ok":true,"count":3,"duration":0.25},
+		{"eventType":"Error","timestamp":1600000000123,"message":"boom"}]`
+	if err := s.Send(context.Background(), []byte(batch), nrinsights.Destination{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if header.Get("Content-Type") != "application/json" || header.Get("Api-Key") != "secret" {
+		t.Errorf("headers %v, want JSON and the Api-Key", header)
+	}
+	if len(got.ResourceLogs) != 1 || len(got.ResourceLogs[0].ScopeLogs) != 1 {
+		t.Fatalf("export request %+v, want one resource and scope", got)
+	}
+	rl := got.ResourceLogs[0]
+	if want := []keyValue{{Key: "service.name", Value: str("checkout")}}; !reflect.DeepEqual(rl.Resource.Attributes, want) {
+		t.Errorf("resource attributes %+v, want service.name", rl.Resource.Attributes)
+	}
+	sl := rl.ScopeLogs[0]
+	if sl.Scope.Name != "nrinsights" || sl.Scope.Version != nrinsights.Version {
+		t.Errorf("scope %+v", sl.Scope)
+	}
+	if len(sl.LogRecords) != 2 {
+		t.Fatalf("%d log records, want 2", len(sl.LogRecords))
+	}
+
+	tx, errEvent := sl.LogRecords[0], sl.LogRecords[1]
+	if *tx.Body.StringValue != "Transaction" || *errEvent.Body.StringValue != "Error" {
+		t.Errorf("bodies %v, %v; want the eventTypes", tx.Body, errEvent.Body)
+	}
+	if tx.TimeUnixNano != "1600000000000000000" || errEvent.TimeUnixNano != "1600000000123000000" {
+		t.Errorf("timeUnixNano %s and %s, want seconds and milliseconds both converted", tx.TimeUnixNano, errEvent.TimeUnixNano)
+	}
+
+	var keys []string
+	attrs := make(map[string]anyValue)
+	for _, kv := range tx.Attributes {
+		keys = append(keys, kv.Key)
+		attrs[kv.Key] = kv.Value
+	}
+	if want := []string{"count", "duration", "eventType", "ok", "timestamp"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("attribute keys %v, want sorted %v", keys, want)
+	}
+	if v := attrs["ok"].BoolValue; v == nil || !*v {
+		t.Errorf("ok = %+v, want boolValue true", attrs["ok"])
+	}
+	if v := attrs["count"].IntValue; v == nil || *v != "3" {
+		t.Errorf("count = %+v, want intValue \"3\"", attrs["count"])
+	}
+	if v := attrs["duration"].DoubleValue; v == nil || *v != 0.25 {
+		t.Errorf("duration = %+v, want doubleValue 0.25", attrs["duration"])
+	}
+}
+
+func TestSendWithoutServiceName(t *testing.T) {
+	var got exportRequest
+	var header http.Header
+	srv := newCollector(t, http.StatusOK, &got, &header)
+	s := &Sender{Endpoint: srv.URL}
+	if err := s.Send(context.Background(), []byte(`[{"eventType":"T"}]`), nrinsights.Destination{}); err != nil {
+		t.Fatal(err)
+	}
+	rec := got.ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+	if len(got.ResourceLogs[0].Resource.Attributes) != 0 || rec.TimeUnixNano != "" {
+		t.Errorf("resource attributes %+v, timeUnixNano %q; want neither", got.ResourceLogs[0].Resource.Attributes, rec.TimeUnixNano)
+	}
+}
+
+func TestSendCollectorError(t *testing.T) {
+	var got exportRequest
+	var header http.Header
+	srv := newCollector(t, http.StatusBadRequest, &got, &header)
+	s := &Sender{Endpoint: srv.URL}
+
+	err := s.Send(context.Background(), []byte(`[{"eventType":"T"}]`), nrinsights.Destination{})
+	if err == nil || !strings.Contains(err.Error(), "400") || !strings.Contains(err.Error(), "collector unhappy") {
+		t.Errorf("Send = %v, want the status and response body", err)
+	}
+}
+
+func TestSendUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	s := &Sender{Endpoint: srv.URL}
+	if err := s.Send(context.Background(), []byte(`[]`), nrinsights.Destination{}); err == nil {
+		t.Error("Send to a closed server succeeded")
+	}
+}
+
+func TestSendBadBatch(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { requests++ }))
+	defer srv.Close()
+	s := &Sender{Endpoint: srv.URL}
+	if err := s.Send(context.Background(), []byte(`{"not":"an array"}`), nrinsights.Destination{}); err == nil {
+		t.Error("Send of a non-array batch succeeded")
+	}
+	if requests != 0 {
+		t.Errorf("%d requests for a batch that didn't decode, want 0", requests)
+	}
+}
@@ -0,0 +1,142 @@
+package nrinsights
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Wraps an http.ResponseWriter to capture the status, timing, and size of a response, as
+// Middleware does.  Use it to build the same events in custom middleware:
+//
+//	event, _ := insights.MakeEventFromRequest(r)
+//	rec := nrinsights.NewResponseRecorder(w)
+//	handler.ServeHTTP(rec, r)
+//	insights.SetResponse(event, rec)
+//	insights.RegisterEvent(event)
+type ResponseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	start       time.Time
+	firstByte   time.Time // of the first WriteHeader or Write, zero if neither was called
+	written     int64
+}
+
+// Wraps w, timing the response from now.
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{ResponseWriter: w, status: 200, start: time.Now()}
+}
+
+// Only the first WriteHeader of a final status reaches the client as the status, so only that one
+// is recorded.  Informational 1xx statuses (e.g. 103 Early Hints) precede it and are skipped, though
+// they do mark the first byte; 101 Switching Protocols is final.
+func (rr *ResponseRecorder) WriteHeader(status int) {
+	if rr.firstByte.IsZero() {
+		rr.firstByte = time.Now()
+	}
+	if !rr.wroteHeader && (status < 100 || status > 199 || status == http.StatusSwitchingProtocols) {
+		rr.status = status
+		rr.wroteHeader = true
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+// A Write without a prior WriteHeader implicitly sends the status already recorded (200).
+func (rr *ResponseRecorder) Write(b []byte) (int, error) {
+	if rr.firstByte.IsZero() {
+		rr.firstByte = time.Now()
+	}
+	rr.wroteHeader = true
+	n, err := rr.ResponseWriter.Write(b)
+	rr.written += int64(n)
+	return n, err
+}
+
+// Flushes the underlying writer if it's an http.Flusher, e.g. for server-sent events; otherwise
+// does nothing.  Like a Write, a Flush sends the status if it wasn't already.
+func (rr *ResponseRecorder) Flush() {
+	flusher, ok := rr.ResponseWriter.(http.Flusher)
+	if !ok {
+		return
+	}
+	if rr.firstByte.IsZero() {
+		rr.firstByte = time.Now()
+	}
+	rr.wroteHeader = true
+	flusher.Flush()
+}
+
+// Hijacks the underlying connection, e.g. for a websocket, if the writer is an http.Hijacker.
+// The response from then on isn't the recorder's to see: its status stays as it was (101 once a
+// handler upgrading the connection sets it).
+func (rr *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("insights: underlying ResponseWriter doesn't support Hijack")
+	}
+	return hijacker.Hijack()
+}
+
+// HTTP/2 server push, if the underlying writer is an http.Pusher; http.ErrNotSupported if not.
+func (rr *ResponseRecorder) Push(target string, opts *http.PushOptions) error {
+	pusher, ok := rr.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return pusher.Push(target, opts)
+}
+
+// The wrapped writer, for http.ResponseController.
+func (rr *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// The response status, 200 unless the handler set another.
+func (rr *ResponseRecorder) Status() int {
+	return rr.status
+}
+
+// Bytes of response body written so far.
+func (rr *ResponseRecorder) BytesWritten() int64 {
+	return rr.written
+}
+
+// Sets call time "duration" (since rr was created) in floating point seconds, time to first byte
+// "ttfb" likewise (omitted if the handler wrote nothing), resulting "status-code", and
+// "responseBytes", the body bytes the handler wrote, plus "response-bytes" (the same) with
+// c.CaptureSizes.  With c.MiddlewareTimestamp set to CompletionTimestamp,
+// "timestamp" is reset to now.  Call once the handler has returned.
+func (c *Connection) SetResponse(e *Event, rr *ResponseRecorder) {
+	c.setResponse(e, rr, time.Now())
+}
+
+func (c *Connection) setResponse(e *Event, rr *ResponseRecorder, end time.Time) {
+	e.Set("duration", end.Sub(rr.start).Seconds())
+	e.Set("status-code", rr.status)
+	e.Set("responseBytes", rr.written)
+	if c.CaptureSizes {
+		e.Set("response-bytes", rr.written)
+	}
+	if !rr.firstByte.IsZero() {
+		e.Set("ttfb", rr.firstByte.Sub(rr.start).Seconds())
+	}
+	if c.MiddlewareTimestamp == CompletionTimestamp {
+		e.SetTimestamp(end)
+	}
+}
+
+// Builds the event Middleware would from r and rr once the handler has returned.  Bodies are read
+// from r.Body, so one the handler consumed isn't captured; to capture it, call MakeEventFromRequest
+// before the handler and SetResponse after, as in the ResponseRecorder example.
+func (c *Connection) MakeEventFromResponse(r *http.Request, rr *ResponseRecorder) (*Event, error) {
+	e, err := c.MakeEventFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	c.SetResponse(e, rr)
+	return e, nil
+}
@@ -0,0 +1,93 @@
+package nrinsights
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEarlyHintsNotRecorded(t *testing.T) {
+	c := startTest(t, &Connection{})
+	event := serve(t, c, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.WriteHeader(http.StatusOK)
+	}, httptest.NewRequest("GET", "/page", nil))
+
+	if event["status-code"] != float64(http.StatusOK) {
+		t.Errorf("status-code = %v, want the final %d", event["status-code"], http.StatusOK)
+	}
+}
+
+// A ResponseWriter with every optional interface, noting which were used.
+type capableWriter struct {
+	http.ResponseWriter
+	flushed  bool
+	hijacked bool
+	pushed   string
+}
+
+func (w *capableWriter) Flush() { w.flushed = true }
+
+func (w *capableWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func (w *capableWriter) Push(target string, opts *http.PushOptions) error {
+	w.pushed = target
+	return nil
+}
+
+// A ResponseWriter with none of them.
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+func TestRecorderDelegates(t *testing.T) {
+	base := &capableWriter{ResponseWriter: httptest.NewRecorder()}
+	var w http.ResponseWriter = NewResponseRecorder(base)
+
+	w.(http.Flusher).Flush()
+	if _, _, err := w.(http.Hijacker).Hijack(); err != nil {
+		t.Errorf("Hijack: %v", err)
+	}
+	if err := w.(http.Pusher).Push("/style.css", nil); err != nil {
+		t.Errorf("Push: %v", err)
+	}
+	if !base.flushed || !base.hijacked || base.pushed != "/style.css" {
+		t.Errorf("flushed %v, hijacked %v, pushed %q; want each passed to the underlying writer", base.flushed, base.hijacked, base.pushed)
+	}
+}
+
+func TestRecorderWithoutOptionalInterfaces(t *testing.T) {
+	var w http.ResponseWriter = NewResponseRecorder(plainWriter{httptest.NewRecorder()})
+
+	w.(http.Flusher).Flush() // does nothing
+	if _, _, err := w.(http.Hijacker).Hijack(); err == nil {
+		t.Error("Hijack succeeded on a writer that can't")
+	}
+	if err := w.(http.Pusher).Push("/style.css", nil); err != http.ErrNotSupported {
+		t.Errorf("Push = %v, want http.ErrNotSupported", err)
+	}
+}
+
+func TestResponseBytes(t *testing.T) {
+	for _, sizes := range []bool{false, true} {
+		c := startTest(t, &Connection{CaptureSizes: sizes})
+		event := serve(t, c, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+			w.Write([]byte(", world"))
+		}, httptest.NewRequest("GET", "/greeting", nil))
+
+		if event["responseBytes"] != float64(12) || event["status-code"] != float64(http.StatusOK) {
+			t.Errorf("CaptureSizes %v: responseBytes = %v, status-code = %v; want 12 and the implicit 200",
+				sizes, event["responseBytes"], event["status-code"])
+		}
+		if _, ok := event["response-bytes"]; ok != sizes {
+			t.Errorf("CaptureSizes %v: response-bytes set %v", sizes, ok)
+		}
+	}
+}
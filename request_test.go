@@ -0,0 +1,154 @@
+package nrinsights
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyOverMaxBodyBytes(t *testing.T) {
+	c := startTest(t, &Connection{MaxBodyBytes: 8, HashBody: true, HashBodyAlongside: true})
+	body := "0123456789abcdef"
+	var read string
+	event := serve(t, c, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		read = string(b)
+	}, httptest.NewRequest("POST", "/upload", strings.NewReader(body)))
+
+	if read != body {
+		t.Errorf("handler read %q, want all of %q", read, body)
+	}
+	if event["body-truncated"] != true || event["body"] != body[:8] {
+		t.Errorf("body-truncated = %v, body = %v; want true, %q", event["body-truncated"], event["body"], body[:8])
+	}
+	if hash, ok := event["body-hash"]; ok {
+		t.Errorf("body-hash = %v of a truncated body, want none", hash)
+	}
+}
+
+// The values MakeEventFromRequest sets for r.
+func requestValues(t *testing.T, c *Connection, r *http.Request) map[string]interface{} {
+	t.Helper()
+	e, err := c.MakeEventFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e.values
+}
+
+func TestMultiValueParams(t *testing.T) {
+	r := httptest.NewRequest("GET", "/search?tag=a&tag=b&q=x", nil)
+	for _, test := range []struct {
+		multi bool
+		want  string
+	}{{false, "a"}, {true, "a,b"}} {
+		values := requestValues(t, &Connection{MultiValueParams: test.multi}, r)
+		if values["p:tag"] != test.want || values["p:q"] != "x" {
+			t.Errorf("MultiValueParams %v: p:tag = %v, p:q = %v; want %q, x", test.multi, values["p:tag"], values["p:q"], test.want)
+		}
+	}
+}
+
+// A JSON POST of body to target.
+func jsonPost(target, body string) *http.Request {
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func TestParamPrefix(t *testing.T) {
+	r := jsonPost("/users?page=2", `{"user":{"name":"ann"},"admin":false}`)
+	values := requestValues(t, &Connection{ParamPrefix: "q_", FlattenPosts: true}, r)
+	for key, want := range map[string]interface{}{"q_page": "2", "q_user.name": "ann", "q_admin": false} {
+		if values[key] != want {
+			t.Errorf("%s = %v, want %v", key, values[key], want)
+		}
+	}
+	if _, ok := values["p:page"]; ok {
+		t.Error("p:page set, want only ParamPrefix's q_page")
+	}
+}
+
+func TestHeadersToCapture(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "curl/8.0")
+	r.Header.Add("X-Request-Id", "abc")
+	r.Header.Add("X-Request-Id", "def")
+	values := requestValues(t, &Connection{HeadersToCapture: []string{"User-Agent", "x-request-id", "Referer"}}, r)
+
+	if values["h:User-Agent"] != "curl/8.0" {
+		t.Errorf("h:User-Agent = %v, want curl/8.0", values["h:User-Agent"])
+	}
+	if values["h:x-request-id"] != "abc,def" {
+		t.Errorf("h:x-request-id = %v, want its values matched case-insensitively and joined", values["h:x-request-id"])
+	}
+	if v, ok := values["h:Referer"]; ok {
+		t.Errorf("h:Referer = %v for an absent header, want none", v)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		trust     bool
+		forwarded string
+		want      string
+	}{
+		{"direct", false, "", "192.0.2.1"},
+		{"untrusted header", false, "203.0.113.7", "192.0.2.1"},
+		{"single hop", true, "203.0.113.7", "203.0.113.7"},
+		{"multiple hops", true, "203.0.113.7, 198.51.100.2, 10.0.0.1", "203.0.113.7"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil) // from 192.0.2.1:1234
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		values := requestValues(t, &Connection{TrustProxyHeaders: test.trust}, r)
+		if values["clientIp"] != test.want {
+			t.Errorf("%s: clientIp = %v, want %s", test.name, values["clientIp"], test.want)
+		}
+	}
+}
+
+func TestSkippedAndRedactedParams(t *testing.T) {
+	for _, hash := range []bool{false, true} {
+		form := httptest.NewRequest("POST", "/login?token=abc&email=ann@example.com&page=1",
+			strings.NewReader("password=hunter2&email=ann@example.com&remember=1"))
+		form.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		body := jsonPost("/signup?email=ann@example.com", `{"user":{"email":"ann@example.com","name":"ann"}}`)
+
+		c := &Connection{
+			FlattenPosts:        true,
+			QueryParamsToSkip:   []string{"Token", "password"},
+			QueryParamsToRedact: []string{"EMAIL", "user.email"},
+			HashRedactedParams:  hash,
+		}
+		masked := "[redacted]"
+		if hash {
+			masked = c.redacted("ann@example.com")
+		}
+
+		values := requestValues(t, c, form)
+		for _, key := range []string{"p:token", "p:password"} {
+			if v, ok := values[key]; ok {
+				t.Errorf("hash %v: skipped %s = %v, want it left off", hash, key, v)
+			}
+		}
+		if values["p:email"] != masked || values["p:page"] != "1" || values["p:remember"] != "1" {
+			t.Errorf("hash %v: p:email = %v, p:page = %v, p:remember = %v; want %s, 1, 1",
+				hash, values["p:email"], values["p:page"], values["p:remember"], masked)
+		}
+
+		values = requestValues(t, c, body)
+		if values["p:email"] != masked || values["p:user.email"] != masked || values["p:user.name"] != "ann" {
+			t.Errorf("hash %v: p:email = %v, p:user.email = %v, p:user.name = %v; want %s, %s, ann",
+				hash, values["p:email"], values["p:user.email"], values["p:user.name"], masked, masked)
+		}
+	}
+	if sum := (&Connection{HashRedactedParams: true}).redacted("ann@example.com"); len(sum) != 64 || strings.Contains(sum, "ann") {
+		t.Errorf("hashed value %q, want a SHA-256 hex", sum)
+	}
+}
@@ -0,0 +1,218 @@
+package nrinsights
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A stand-in collector answering each request with respond, keeping the requests' bodies.
+type collector struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newCollector(t *testing.T, respond http.HandlerFunc) *collector {
+	col := &collector{}
+	col.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		col.mu.Lock()
+		col.requests = append(col.requests, r)
+		col.bodies = append(col.bodies, body)
+		col.mu.Unlock()
+		respond(w, r)
+	}))
+	t.Cleanup(col.Close)
+	return col
+}
+
+func (col *collector) received() int {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	return len(col.requests)
+}
+
+// A Connection sending to col.
+func (col *collector) connection(c *Connection) *Connection {
+	c.Endpoint = col.URL
+	c.InsightsAPIKey = "key"
+	c.NewRelicAccountId = 1
+	return c
+}
+
+// Registers an event and gives Flush up to d to send it.
+func registerAndFlush(t *testing.T, c *Connection, d time.Duration) error {
+	t.Helper()
+	if err := c.RegisterEvent(c.NewEvent()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return c.Flush(ctx)
+}
+
+func TestPartialSuccessOnAny2xx(t *testing.T) {
+	col := newCollector(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"partialSuccess":{"rejected":3}}`))
+	})
+	c := startTest(t, col.connection(&Connection{RejectedEventsPath: "partialSuccess.rejected"}))
+
+	if err := registerAndFlush(t, c, 2*time.Second); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	stats := c.Stats()
+	if stats.BatchesSent != 1 || stats.SendFailures != 0 || stats.RejectedEvents != 3 {
+		t.Errorf("BatchesSent %d, SendFailures %d, RejectedEvents %d; want 1, 0, 3",
+			stats.BatchesSent, stats.SendFailures, stats.RejectedEvents)
+	}
+}
+
+func TestServerErrorIsSendFailure(t *testing.T) {
+	col := newCollector(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	c := startTest(t, col.connection(&Connection{RetryBackoff: time.Hour}))
+
+	if err := registerAndFlush(t, c, 200*time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("Flush = %v, want DeadlineExceeded with the batch unsent", err)
+	}
+	stats := c.Stats()
+	if stats.BatchesSent != 0 || stats.SendFailures != 1 || stats.UnsentBatches != 1 {
+		t.Errorf("BatchesSent %d, SendFailures %d, UnsentBatches %d; want 0, 1, 1",
+			stats.BatchesSent, stats.SendFailures, stats.UnsentBatches)
+	}
+	if n := col.received(); n != 1 {
+		t.Errorf("collector got %d requests, want 1: the resend waits out RetryBackoff", n)
+	}
+}
+
+func TestCompressedResend(t *testing.T) {
+	var failed int32
+	col := newCollector(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	c := startTest(t, col.connection(&Connection{Compress: true}))
+
+	b := &batch{json: `[{"eventType":"Transaction"}]`}
+	if c.sendBatch(b, &SendResult{}) {
+		t.Fatal("first send succeeded, want the 503")
+	}
+	gz := b.gz
+	if !c.sendBatch(b, &SendResult{}) {
+		t.Fatal("resend failed")
+	}
+	if len(gz) == 0 || &b.gz[0] != &gz[0] {
+		t.Error("resend compressed the batch again rather than reusing b.gz")
+	}
+
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	if len(col.requests) != 2 {
+		t.Fatalf("collector got %d requests, want 2", len(col.requests))
+	}
+	for i, r := range col.requests {
+		if enc := r.Header.Get("Content-Encoding"); enc != "gzip" {
+			t.Errorf("request %d: Content-Encoding %q, want gzip", i, enc)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(col.bodies[i]))
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if body, err := ioutil.ReadAll(zr); err != nil || string(body) != b.json {
+			t.Errorf("request %d: gunzipped %q, %v; want %q", i, body, err, b.json)
+		}
+	}
+}
+
+// Waits up to 2s for col to have n requests.
+func (col *collector) await(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if col.received() >= n {
+			return
+		}
+	}
+	t.Fatalf("collector got %d requests, want %d", col.received(), n)
+}
+
+func TestRetryAfterCoolDown(t *testing.T) {
+	var limited int32
+	col := newCollector(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.CompareAndSwapInt32(&limited, 0, 1) {
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	})
+	fc := newFakeClock()
+	c := startTest(t, col.connection(&Connection{RetryBackoff: 10 * time.Millisecond, clock: fc}))
+
+	c.RegisterEvent(c.NewEvent())
+	c.FlushType("Transaction")
+	col.await(t, 1)
+	awaitTimer(t, fc.afters, 2*time.Second)
+
+	c.RegisterEvent(c.NewEvent()) // batched during the cool-down, and held with the first
+	c.FlushType("Transaction")
+	fc.Advance(2*time.Second - time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if n := col.received(); n != 1 {
+		t.Fatalf("collector got %d requests during the cool-down, want just the 429", n)
+	}
+	if n := c.Stats().UnsentBatches; n != 2 {
+		t.Errorf("%d unsent batches during the cool-down, want 2", n)
+	}
+
+	fc.Advance(time.Millisecond)
+	col.await(t, 3)
+}
+
+func TestEventsURL(t *testing.T) {
+	tests := []struct {
+		c    *Connection
+		want string
+	}{
+		{&Connection{}, "https://insights-collector.newrelic.com/v1/accounts/7/events"},
+		{&Connection{Region: RegionUS}, "https://insights-collector.newrelic.com/v1/accounts/7/events"},
+		{&Connection{Region: RegionEU}, "https://insights-collector.eu01.nr-data.net/v1/accounts/7/events"},
+		{&Connection{Region: RegionFedRAMP}, "https://gov-insights-collector.newrelic.com/v1/accounts/7/events"},
+		{&Connection{Endpoint: "http://localhost:8080"}, "http://localhost:8080/v1/accounts/7/events"},
+		{&Connection{Endpoint: "http://localhost:8080/", Region: RegionEU}, "http://localhost:8080/v1/accounts/7/events"},
+	}
+	for _, test := range tests {
+		if got := test.c.eventsURL(7); got != test.want {
+			t.Errorf("Region %v, Endpoint %q: %s, want %s", test.c.Region, test.c.Endpoint, got, test.want)
+		}
+	}
+}
+
+func TestRetryAfterDateOnClock(t *testing.T) {
+	fc := newFakeClock()
+	var limited int32
+	col := newCollector(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.CompareAndSwapInt32(&limited, 0, 1) {
+			w.Header().Set("Retry-After", fc.Now().Add(3*time.Second).UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	})
+	c := startTest(t, col.connection(&Connection{RetryBackoff: 10 * time.Millisecond, clock: fc}))
+
+	c.RegisterEvent(c.NewEvent())
+	c.FlushType("Transaction")
+	col.await(t, 1)
+	awaitTimer(t, fc.afters, 3*time.Second) // a cool-down per the clock, rather than long past
+
+	fc.Advance(3 * time.Second)
+	col.await(t, 2)
+}
@@ -0,0 +1,148 @@
+package nrinsights
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	spoolPrefix = "nrinsights-"
+	spoolSuffix = ".json"
+)
+
+// A batch as written to c.SpoolDir.  A Destination's insert key isn't, to keep credentials off
+// disk, so such a batch is resent with the Connection's.
+type spooledBatch struct {
+	AccountId int             `json:"accountId,omitempty"`
+	Priority  Priority        `json:"priority"`
+	Events    int             `json:"events"`
+	Batch     json.RawMessage `json:"batch"`
+}
+
+// Writes the batches still unsent to c.SpoolDir, one file each, skipping those already spooled.
+// Called at the end of the final flush.
+func (c *Connection) spoolUnsent() {
+	c.unsentLock.Lock()
+	var pending []*batch
+	for elem := c.unsent.Front(); elem != nil; elem = elem.Next() {
+		if b := elem.Value.(*batch); b.spoolFile == "" {
+			pending = append(pending, b)
+		}
+	}
+	c.unsentLock.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	if err := os.MkdirAll(c.SpoolDir, 0700); err != nil {
+		c.log().Printf("insights: can't spool %d unsent batches: %v", len(pending), err)
+		return
+	}
+
+	stamp := time.Now().UnixNano()
+	for i, b := range pending {
+		name := filepath.Join(c.SpoolDir, fmt.Sprintf("%s%d-%04d%s", spoolPrefix, stamp, i, spoolSuffix))
+		if err := writeSpoolFile(name, b); err != nil {
+			c.log().Printf("insights: can't spool batch of %d bytes: %v", len(b.json), err)
+		}
+	}
+	c.log().Printf("insights: spooled %d unsent batches to %s", len(pending), c.SpoolDir)
+}
+
+// Writes b to name by way of a temporary file, so a crash mid-write leaves no partial batch.
+func writeSpoolFile(name string, b *batch) error {
+	contents, err := json.Marshal(spooledBatch{
+		AccountId: b.dest.AccountId,
+		Priority:  b.priority,
+		Events:    b.events,
+		Batch:     json.RawMessage(b.json),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// Queues the batches spooled in c.SpoolDir for resend, oldest first, returning how many.  Their
+// files stay until they're sent (or dropped).  Unreadable or corrupt files are logged and left, as
+// are those that won't fit in MaxMemoryBytes.
+func (c *Connection) loadSpool() int {
+	files, err := ioutil.ReadDir(c.SpoolDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.log().Printf("insights: can't read SpoolDir: %v", err)
+		}
+		return 0
+	}
+
+	loaded := 0
+	for _, f := range files { // sorted by name, so by spool time
+		if f.IsDir() || !strings.HasPrefix(f.Name(), spoolPrefix) || !strings.HasSuffix(f.Name(), spoolSuffix) {
+			continue
+		}
+
+		name := filepath.Join(c.SpoolDir, f.Name())
+		b, err := readSpoolFile(name)
+		if err != nil {
+			c.log().Printf("insights: skipping spool file %s: %v", name, err)
+			continue
+		}
+
+		// Not through reserveMemory, which would shed batches loaded before this one.
+		if c.MaxMemoryBytes > 0 && atomic.LoadInt64(&c.counters.memoryBytes)+int64(len(b.json)) > c.MaxMemoryBytes {
+			c.log().Printf("insights: MaxMemoryBytes reached; leaving spool file %s for a later Start", name)
+			continue
+		}
+		atomic.AddInt64(&c.counters.memoryBytes, int64(len(b.json)))
+		c.pushUnsent(b)
+		loaded++
+	}
+	return loaded
+}
+
+func readSpoolFile(name string) (*batch, error) {
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var s spooledBatch
+	if err := json.Unmarshal(contents, &s); err != nil {
+		return nil, err
+	}
+	if len(s.Batch) == 0 || s.Batch[0] != '[' {
+		return nil, fmt.Errorf("no batch of events")
+	}
+	if s.Priority != NormalPriority && s.Priority != HighPriority {
+		return nil, fmt.Errorf("unknown priority %d", s.Priority)
+	}
+
+	return &batch{
+		json:      string(s.Batch),
+		dest:      Destination{AccountId: s.AccountId},
+		priority:  s.Priority,
+		events:    s.Events,
+		spoolFile: name,
+	}, nil
+}
+
+// Removes b's spool file, if it came from one, once b is sent or dropped.
+func (c *Connection) unspool(b *batch) {
+	if b.spoolFile == "" {
+		return
+	}
+	if err := os.Remove(b.spoolFile); err != nil && !os.IsNotExist(err) {
+		c.log().Printf("insights: can't remove spool file: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package nrinsights
+
+import (
+	"container/list"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSpoolWithinMaxMemoryBytes(t *testing.T) {
+	dir := t.TempDir()
+	json := `[{"eventType":"Transaction"}]`
+	for _, name := range []string{"nrinsights-1-0000.json", "nrinsights-1-0001.json"} {
+		if err := writeSpoolFile(filepath.Join(dir, name), &batch{json: json, events: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &Connection{SpoolDir: dir, MaxMemoryBytes: int64(len(json) + 10), counters: &counters{}, Logger: testLogger{t}}
+	c.unsent = list.New()
+	if n := c.loadSpool(); n != 1 {
+		t.Fatalf("loaded %d spooled batches, want the 1 that fits", n)
+	}
+	if n := c.counters.memoryBytes; n != int64(len(json)) {
+		t.Errorf("MemoryBytes %d, want %d", n, len(json))
+	}
+
+	b := c.unsent.Front().Value.(*batch)
+	c.dropBatch(b)
+	if n := c.counters.memoryBytes; n != 0 {
+		t.Errorf("MemoryBytes %d once the loaded batch is dropped, want 0", n)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || !strings.HasSuffix(files[0].Name(), "0001.json") {
+		t.Errorf("spool files left %v, want just the one not loaded", files)
+	}
+}
@@ -0,0 +1,70 @@
+package nrinsights
+
+import "net/url"
+
+var regionNames = map[Region]string{
+	RegionUS:      "US",
+	RegionEU:      "EU",
+	RegionFedRAMP: "FedRAMP",
+}
+
+func (r Region) String() string {
+	if name, ok := regionNames[r]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// An "InsightsConfig" event describing how c is configured, for EmitStartupConfig.  Credentials
+// (insert keys, Endpoint userinfo) and anything derived from them are left out.
+func (c *Connection) startupConfigEvent() *Event {
+	e := c.NewEvent()
+	e.SetSource("nrinsights")
+	e.Set("eventType", "InsightsConfig")
+	e.Set("version", Version)
+
+	e.Set("collector-region", c.Region.String()) // "region" is ServerRegion's
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err == nil {
+			e.Set("endpoint-host", u.Host)
+		}
+	}
+	e.Set("custom-sender", c.Sender != nil)
+	e.Set("custom-http-client", c.HTTPClient != nil)
+	e.Set("compress", c.Compress)
+
+	e.Set("send-interval-seconds", c.sendInterval().Seconds())
+	e.Set("high-priority-interval-seconds", c.highPriorityInterval().Seconds())
+	e.Set("send-queue-size", c.sendQueueSize())
+	e.Set("early-batch-fraction", c.earlyBatchFraction())
+	e.Set("max-batch-queues", c.maxBatchQueues())
+	e.Set("coalesce-events", c.coalesceEvents())
+	e.Set("max-batches-per-tick", c.MaxBatchesPerTick)
+	e.Set("max-memory-bytes", c.MaxMemoryBytes)
+	e.Set("max-retries", c.MaxRetries)
+	e.Set("retry-backoff-seconds", c.retryBackoff(1).Seconds())
+	e.Set("expire-normal-above", c.ExpireNormalAbove)
+	e.Set("shutdown-retries", c.ShutdownRetries)
+	e.Set("shutdown-timeout-seconds", c.ShutdownTimeout.Seconds())
+
+	e.Set("max-query-params", c.config().maxQueryParams())
+	e.Set("query-params-skipped", len(c.QueryParamsToSkip))
+	e.Set("flatten-posts", c.FlattenPosts)
+	e.Set("flatten-sample-rate", c.FlattenSampleRate)
+	e.Set("hash-body", c.HashBody)
+	e.Set("compress-bodies-over", c.CompressBodiesOver)
+	e.Set("capture-sizes", c.CaptureSizes)
+	e.Set("capture-content-types", c.CaptureContentTypes)
+	e.Set("capture-tls", c.CaptureTLS)
+
+	e.Set("strict-validation", c.StrictValidation)
+	e.Set("millisecond-timestamps", c.MillisecondTimestamps)
+	e.Set("precise-numbers", c.PreciseNumbers)
+	e.Set("sanitize-strings", int(c.SanitizeStrings))
+	e.Set("recover-panics", c.RecoverPanics)
+	e.Set("swallow-panics", c.SwallowPanics)
+	e.Set("correlation-ids", c.CorrelationIds)
+	e.Set("record-commit", c.RecordCommit)
+	e.Set("record-uptime", c.RecordUptime)
+	return e
+}
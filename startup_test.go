@@ -0,0 +1,14 @@
+package nrinsights
+
+import "testing"
+
+func TestStartupConfigKeepsServerRegion(t *testing.T) {
+	c := &Connection{Region: RegionEU, ServerRegion: "us-east-1"}
+	e := c.startupConfigEvent()
+	if e.values["region"] != "us-east-1" {
+		t.Errorf("region = %v, want ServerRegion's us-east-1", e.values["region"])
+	}
+	if e.values["collector-region"] != "EU" {
+		t.Errorf("collector-region = %v, want EU", e.values["collector-region"])
+	}
+}
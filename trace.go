@@ -0,0 +1,62 @@
+package nrinsights
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Where the time sending a batch went, from net/http/httptrace.  Phases a reused connection
+// skips are zero.
+type SendTrace struct {
+	ReusedConn bool
+	DNS        time.Duration
+	Connect    time.Duration
+	TLS        time.Duration
+
+	// From the request being written to the first response byte -- the collector's own time
+	ServerWait time.Duration
+
+	lock                                       sync.Mutex
+	dnsStart, connectStart, tlsStart, wroteReq time.Time
+}
+
+func (st *SendTrace) clientTrace() *httptrace.ClientTrace {
+	// Dials may race (e.g. IPv4 and IPv6), so every hook locks.
+	mark := func(f func()) {
+		st.lock.Lock()
+		f()
+		st.lock.Unlock()
+	}
+
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mark(func() { st.ReusedConn = info.Reused })
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mark(func() { st.dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mark(func() { st.DNS = time.Since(st.dnsStart) })
+		},
+		ConnectStart: func(string, string) {
+			mark(func() { st.connectStart = time.Now() })
+		},
+		ConnectDone: func(string, string, error) {
+			mark(func() { st.Connect = time.Since(st.connectStart) })
+		},
+		TLSHandshakeStart: func() {
+			mark(func() { st.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			mark(func() { st.TLS = time.Since(st.tlsStart) })
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mark(func() { st.wroteReq = time.Now() })
+		},
+		GotFirstResponseByte: func() {
+			mark(func() { st.ServerWait = time.Since(st.wroteReq) })
+		},
+	}
+}
@@ -0,0 +1,278 @@
+package nrinsights
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var builtinEncoders = map[reflect.Type]Encoder{
+	reflect.TypeOf(time.Time{}): func(v interface{}) interface{} {
+		return v.(time.Time).Format(time.RFC3339Nano)
+	},
+	reflect.TypeOf(time.Duration(0)): func(v interface{}) interface{} {
+		return v.(time.Duration).Seconds()
+	},
+}
+
+// Returns values with those of registered types encoded, copying values only if any are.
+func (c *Connection) encodeValues(values map[string]interface{}) map[string]interface{} {
+	var encoded map[string]interface{}
+	for k, v := range values {
+		if v == nil {
+			continue
+		}
+		t := reflect.TypeOf(v)
+		fn, ok := c.encoders[t]
+		if !ok {
+			fn, ok = builtinEncoders[t]
+		}
+		if !ok {
+			continue
+		}
+
+		if encoded == nil {
+			encoded = make(map[string]interface{}, len(values))
+			for k, v := range values {
+				encoded[k] = v
+			}
+		}
+		encoded[k] = fn(v)
+	}
+
+	if encoded == nil {
+		return values
+	}
+	return encoded
+}
+
+// Returns values with those New Relic doesn't accept stringified or dropped per
+// c.UnsupportedValues, copying values only if any are.  A type marshaling itself to a JSON string,
+// number or boolean is accepted as is.
+func (c *Connection) coerceValues(values map[string]interface{}) map[string]interface{} {
+	var coerced map[string]interface{}
+	var dropped []string
+	for k, v := range values {
+		if v == nil || scalarValue(v) {
+			continue
+		}
+		asjson, err := json.Marshal(v)
+		if err == nil && len(asjson) > 0 && asjson[0] != '[' && asjson[0] != '{' && string(asjson) != "null" {
+			continue
+		}
+
+		if coerced == nil {
+			coerced = make(map[string]interface{}, len(values))
+			for k, v := range values {
+				coerced[k] = v
+			}
+		}
+		if c.UnsupportedValues == DropUnsupported {
+			delete(coerced, k)
+			dropped = append(dropped, k)
+		} else if err != nil {
+			coerced[k] = fmt.Sprint(v)
+		} else {
+			coerced[k] = string(asjson)
+		}
+	}
+
+	if len(dropped) > 0 {
+		sort.Strings(dropped)
+		c.log().Printf("insights RegisterEvent: dropped attributes of unsupported types: %s", strings.Join(dropped, ", "))
+	}
+	if coerced == nil {
+		return values
+	}
+	return coerced
+}
+
+// Whether v is of a kind New Relic accepts as an attribute value.
+func scalarValue(v interface{}) bool {
+	switch reflect.TypeOf(v).Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// Returns a copy of values keeping only limit attributes -- "eventType" and "timestamp", then the
+// others first by sorted name -- along with the names of those dropped.
+func dropExtraAttributes(values map[string]interface{}, limit int) (kept map[string]interface{}, dropped []string) {
+	names := make([]string, 0, len(values))
+	for k := range values {
+		if k != "eventType" && k != "timestamp" {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	kept = make(map[string]interface{}, limit)
+	for _, k := range []string{"eventType", "timestamp"} {
+		if v, ok := values[k]; ok {
+			kept[k] = v
+		}
+	}
+	for _, k := range names {
+		if len(kept) < limit {
+			kept[k] = values[k]
+		} else {
+			dropped = append(dropped, k)
+		}
+	}
+	return kept, dropped
+}
+
+// Marks strings cut short by truncateLargest and truncateValues.
+const truncatedMarker = "…[truncated]"
+
+// Returns values with string values over limit bytes cut short to fit, marked, copying values
+// only if any are.
+func truncateValues(values map[string]interface{}, limit int) map[string]interface{} {
+	keep := limit - len(truncatedMarker)
+	if keep < 0 {
+		keep = 0
+	}
+
+	var truncated map[string]interface{}
+	for k, v := range values {
+		str, ok := v.(string)
+		if !ok || len(str) <= limit {
+			continue
+		}
+
+		if truncated == nil {
+			truncated = make(map[string]interface{}, len(values))
+			for k, v := range values {
+				truncated[k] = v
+			}
+		}
+		truncated[k] = truncateString(str, keep) + truncatedMarker
+	}
+
+	if truncated == nil {
+		return values
+	}
+	return truncated
+}
+
+// Returns a copy of values with its largest string value shortened by at least excess bytes (and
+// marked), or ok false if there's no string long enough.
+func truncateLargest(values map[string]interface{}, excess int) (truncated map[string]interface{}, ok bool) {
+	largest, size := "", 0
+	for k, v := range values {
+		if str, isString := v.(string); isString && len(str) > size {
+			largest, size = k, len(str)
+		}
+	}
+	keep := size - excess - len(truncatedMarker)
+	if keep <= 0 {
+		return values, false
+	}
+
+	truncated = make(map[string]interface{}, len(values))
+	for k, v := range values {
+		truncated[k] = v
+	}
+	truncated[largest] = truncateString(values[largest].(string), keep) + truncatedMarker
+	return truncated, true
+}
+
+// Returns a copy of values with every string value cleaned per mode.
+func sanitizeValues(values map[string]interface{}, mode SanitizeMode) map[string]interface{} {
+	clean := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if str, ok := v.(string); ok {
+			v = sanitizeString(str, mode)
+		}
+		clean[k] = v
+	}
+	return clean
+}
+
+// Returns a copy of values with floats as json.Numbers that encoding/json writes verbatim: whole
+// floats in int64 range as integers, others in plain decimal rather than exponent notation.
+func preciseNumbers(values map[string]interface{}) map[string]interface{} {
+	precise := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		switch f := v.(type) {
+		case float32:
+			v = preciseFloat(float64(f), 32)
+		case float64:
+			v = preciseFloat(f, 64)
+		}
+		precise[k] = v
+	}
+	return precise
+}
+
+func preciseFloat(f float64, bits int) interface{} {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return f // unencodable either way; leave it to json.Marshal to report
+	}
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		return json.Number(strconv.FormatInt(int64(f), 10))
+	}
+	return json.Number(strconv.FormatFloat(f, 'f', -1, bits))
+}
+
+func sanitizeString(s string, mode SanitizeMode) string {
+	if isClean(s) {
+		return s
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+
+		if (r == utf8.RuneError && size == 1) || isUnwantedControl(r) {
+			if mode == ReplaceControlChars {
+				b.WriteRune(utf8.RuneError)
+			}
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func isClean(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if isUnwantedControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whitespace controls are kept since stack traces and bodies rely on them.
+func isUnwantedControl(r rune) bool {
+	return unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r'
+}
+
+// Returns a copy of values with each value json can't marshal replaced by its "%v" string.
+func stringifyUnmarshalable(values map[string]interface{}) map[string]interface{} {
+	safe := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if _, err := json.Marshal(v); err != nil {
+			v = fmt.Sprintf("%v", v)
+		}
+		safe[k] = v
+	}
+	return safe
+}
@@ -0,0 +1,71 @@
+package nrinsights
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestOversizedValueTruncated(t *testing.T) {
+	for _, limit := range []int{0, 100} { // the default, and a MaxValueBytes
+		c := startTest(t, &Connection{MaxValueBytes: limit})
+		if limit == 0 {
+			limit = maxValueBytes
+		}
+		ch := c.Subscribe()
+		e := c.NewEvent()
+		e.Set("body", strings.Repeat("é", limit)) // two bytes each, so cut mid-rune without care
+		e.Set("short", "kept")
+		if err := c.RegisterEvent(e); err != nil {
+			t.Fatal(err)
+		}
+
+		event := nextEvent(t, ch)
+		body, _ := event["body"].(string)
+		if len(body) > limit || !strings.HasSuffix(body, truncatedMarker) || !utf8.ValidString(body) {
+			t.Errorf("limit %d: body of %d bytes, want at most %d of valid UTF-8 ending %q", limit, len(body), limit, truncatedMarker)
+		}
+		if event["short"] != "kept" {
+			t.Errorf("limit %d: short = %v, want it untouched", limit, event["short"])
+		}
+	}
+}
+
+func TestUnsupportedValues(t *testing.T) {
+	type point struct{ X, Y int }
+	values := map[string]interface{}{
+		"slice":   []int{1, 2},
+		"map":     map[string]int{"a": 1},
+		"struct":  point{1, 2},
+		"nilptr":  (*point)(nil),
+		"string":  "kept",
+		"number":  3.5,
+		"boolean": true,
+	}
+	scalars := map[string]interface{}{"string": "kept", "number": 3.5, "boolean": true}
+
+	stringified := map[string]interface{}{
+		"slice":  "[1,2]",
+		"map":    `{"a":1}`,
+		"struct": `{"X":1,"Y":2}`,
+		"nilptr": "null",
+	}
+	for k, v := range scalars {
+		stringified[k] = v
+	}
+
+	for _, test := range []struct {
+		policy ValuePolicy
+		want   map[string]interface{}
+	}{{StringifyUnsupported, stringified}, {DropUnsupported, scalars}} {
+		c := &Connection{UnsupportedValues: test.policy, Logger: testLogger{t}}
+		got := c.coerceValues(values)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("policy %d: %v, want %v", test.policy, got, test.want)
+		}
+	}
+	if _, ok := values["slice"].([]int); !ok {
+		t.Error("coerceValues changed the values it was given")
+	}
+}